@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+const (
+	readsPageSize = 1000
+	infoBatchSize = 500
+	dateFormat    = "2006-01-02"
+)
+
+type ViewerEdge struct {
+	Uid  string    `json:"uid"`
+	Time time.Time `json:"content|time"`
+}
+
+type ViewerNode struct {
+	Uid     string       `json:"uid"`
+	Content []ViewerEdge `json:"content"`
+}
+
+type ViewerNodeResponse struct {
+	Viewers []ViewerNode `json:"viewers"`
+}
+
+type InfoResponse struct {
+	Info []DGraphStats `json:"info"`
+}
+
+// viewerRead is one content edge of a Viewer. Dgraph keeps one edge per
+// viewer and content, so a re-read moves the time rather than adding a
+// read.
+type viewerRead struct {
+	viewer  string
+	content string
+	time    time.Time
+}
+
+// loadReads returns every read with a time in [from, to).
+func loadReads(ctx context.Context, dg *dgo.Dgraph, from, to time.Time) ([]viewerRead, error) {
+	q := `query Reads($after: string, $first: int) {
+		viewers(func: type(Viewer), first: $first, after: $after) {
+			uid
+			content @facets(ge(time, "` + from.UTC().Format(time.RFC3339) + `") AND lt(time, "` + to.UTC().Format(time.RFC3339) + `")) @facets(time) {
+				uid
+			}
+		}
+	}`
+
+	reads := []viewerRead{}
+	after := "0x0"
+	for {
+		txn := dg.NewReadOnlyTxn()
+		res, err := txn.QueryWithVars(ctx, q, map[string]string{"$after": after, "$first": fmt.Sprint(readsPageSize)})
+		txn.Discard(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var resp ViewerNodeResponse
+		err = json.Unmarshal(res.Json, &resp)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range resp.Viewers {
+			for _, c := range v.Content {
+				reads = append(reads, viewerRead{v.Uid, c.Uid, c.Time})
+			}
+		}
+
+		if len(resp.Viewers) < readsPageSize {
+			break
+		}
+		after = resp.Viewers[len(resp.Viewers)-1].Uid
+	}
+
+	return reads, nil
+}
+
+// loadContentInfo fetches name, type, writers and artists for the uids.
+func loadContentInfo(ctx context.Context, dg *dgo.Dgraph, uids []string) (map[string]DGraphStats, error) {
+	info := map[string]DGraphStats{}
+
+	for len(uids) > 0 {
+		n := infoBatchSize
+		if n > len(uids) {
+			n = len(uids)
+		}
+		batch := []string{}
+		for _, uid := range uids[:n] {
+			if validUid(uid) {
+				batch = append(batch, uid)
+			}
+		}
+		uids = uids[n:]
+		if len(batch) == 0 {
+			continue
+		}
+
+		q := `{
+			info(func: uid(` + strings.Join(batch, ",") + `)) @filter(type(Content)) {
+				uid
+				name
+				type
+				pic
+				read_count
+				written_by {
+					name
+				}
+				artist {
+					name
+				}
+			}
+		}`
+
+		txn := dg.NewReadOnlyTxn()
+		res, err := txn.Query(ctx, q)
+		txn.Discard(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var resp InfoResponse
+		err = json.Unmarshal(res.Json, &resp)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range resp.Info {
+			info[c.Uid] = c
+		}
+	}
+
+	return info, nil
+}
+
+type SeriesPoint struct {
+	Period  string
+	Reads   int
+	Readers int
+	// Width is Reads in percent of the busiest period, for the bar chart.
+	Width int
+}
+
+type TopContent struct {
+	Uid    string
+	Name   string
+	Artist string
+	Writer string
+	Type   string
+	Reads  int
+}
+
+type Breakdown struct {
+	Name  string
+	Reads int
+}
+
+type AnalyticsReport struct {
+	From    string
+	To      string
+	Bucket  string
+	Total   int
+	Series  []SeriesPoint
+	Top     []TopContent
+	Types   []Breakdown
+	Writers []Breakdown
+}
+
+// bucketKey names the day, ISO week or month t falls in.
+func bucketKey(t time.Time, bucket string) string {
+	switch bucket {
+	case "day":
+		return t.Format(dateFormat)
+	case "month":
+		return t.Format("2006-01")
+	default:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}
+}
+
+func writerNames(list []DGraphContributor) string {
+	names := []string{}
+	for _, c := range list {
+		names = append(names, c.Name)
+	}
+	return strings.Join(names, " & ")
+}
+
+func sortedBreakdown(counts map[string]int) []Breakdown {
+	list := []Breakdown{}
+	for name, n := range counts {
+		list = append(list, Breakdown{name, n})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Reads != list[j].Reads {
+			return list[i].Reads > list[j].Reads
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func buildReport(reads []viewerRead, info map[string]DGraphStats, from, to time.Time, bucket string, top int) AnalyticsReport {
+	report := AnalyticsReport{
+		From:   from.Format(dateFormat),
+		To:     to.AddDate(0, 0, -1).Format(dateFormat),
+		Bucket: bucket,
+	}
+
+	index := map[string]int{}
+	for d := from; d.Before(to); d = d.AddDate(0, 0, 1) {
+		key := bucketKey(d, bucket)
+		if _, ok := index[key]; !ok {
+			index[key] = len(report.Series)
+			report.Series = append(report.Series, SeriesPoint{Period: key})
+		}
+	}
+
+	readers := map[string]map[string]bool{}
+	perContent := map[string]int{}
+	types := map[string]int{}
+	writers := map[string]int{}
+
+	for _, r := range reads {
+		c, ok := info[r.content]
+		if !ok {
+			// The content is gone or is not Content.
+			continue
+		}
+		report.Total++
+
+		key := bucketKey(r.time.UTC(), bucket)
+		if i, ok := index[key]; ok {
+			report.Series[i].Reads++
+			if readers[key] == nil {
+				readers[key] = map[string]bool{}
+			}
+			readers[key][r.viewer] = true
+		}
+
+		perContent[r.content]++
+		types[typeText(c.Type)]++
+		for _, w := range c.WrittenBy {
+			writers[w.Name]++
+		}
+	}
+
+	max := 0
+	for key, i := range index {
+		report.Series[i].Readers = len(readers[key])
+		if report.Series[i].Reads > max {
+			max = report.Series[i].Reads
+		}
+	}
+	if max > 0 {
+		for i := range report.Series {
+			report.Series[i].Width = report.Series[i].Reads * 100 / max
+		}
+	}
+
+	for uid, n := range perContent {
+		c := info[uid]
+		report.Top = append(report.Top, TopContent{
+			Uid:    uid,
+			Name:   c.Name,
+			Artist: artistNames(c.Artist),
+			Writer: writerNames(c.WrittenBy),
+			Type:   typeText(c.Type),
+			Reads:  n,
+		})
+	}
+	sort.Slice(report.Top, func(i, j int) bool {
+		if report.Top[i].Reads != report.Top[j].Reads {
+			return report.Top[i].Reads > report.Top[j].Reads
+		}
+		return report.Top[i].Uid < report.Top[j].Uid
+	})
+	if len(report.Top) > top {
+		report.Top = report.Top[:top]
+	}
+
+	report.Types = sortedBreakdown(types)
+	report.Writers = sortedBreakdown(writers)
+
+	return report
+}
+
+// dateRange reads from and to (inclusive) as dates from the query,
+// defaulting to the last 90 days. The returned to is exclusive.
+func dateRange(r *http.Request) (time.Time, time.Time, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	to := today.AddDate(0, 0, 1)
+	from := to.AddDate(0, 0, -90)
+
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := time.Parse(dateFormat, v)
+		if err != nil {
+			return from, to, err
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := time.Parse(dateFormat, v)
+		if err != nil {
+			return from, to, err
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+
+	return from, to, nil
+}
+
+func (app *application) analyticsReport(ctx context.Context, from, to time.Time, bucket string) (AnalyticsReport, error) {
+	key := fmt.Sprintf("%s|%s|%s", from.Format(dateFormat), to.Format(dateFormat), bucket)
+
+	return app.reports.get(key, func() (AnalyticsReport, error) {
+		dc := api.NewDgraphClient(app.conn)
+		dg := dgo.NewDgraphClient(dc)
+
+		reads, err := loadReads(ctx, dg, from, to)
+		if err != nil {
+			return AnalyticsReport{}, err
+		}
+
+		seen := map[string]bool{}
+		uids := []string{}
+		for _, r := range reads {
+			if !seen[r.content] {
+				seen[r.content] = true
+				uids = append(uids, r.content)
+			}
+		}
+
+		info, err := loadContentInfo(ctx, dg, uids)
+		if err != nil {
+			return AnalyticsReport{}, err
+		}
+
+		return buildReport(reads, info, from, to, bucket, 50), nil
+	})
+}
+
+// analytics shows reads over time computed from the Viewer time facets.
+// With format=csv one of the tables is exported instead.
+func (app *application) analytics(w http.ResponseWriter, r *http.Request) {
+	from, to, err := dateRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bucket := r.URL.Query().Get("bucket")
+	if bucket != "day" && bucket != "month" {
+		bucket = "week"
+	}
+
+	report, err := app.analyticsReport(r.Context(), from, to, bucket)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Could not compute analytics", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		writeReportCsv(w, report, r.URL.Query().Get("report"))
+		return
+	}
+
+	app.executeTemplate(w, "analytics", report)
+}
+
+func writeReportCsv(w http.ResponseWriter, report AnalyticsReport, table string) {
+	rows := [][]string{}
+
+	switch table {
+	case "top":
+		rows = append(rows, []string{"uid", "name", "artist", "writer", "type", "reads"})
+		for _, t := range report.Top {
+			rows = append(rows, []string{t.Uid, t.Name, t.Artist, t.Writer, t.Type, strconv.Itoa(t.Reads)})
+		}
+	case "types", "writers":
+		list := report.Types
+		if table == "writers" {
+			list = report.Writers
+		}
+		rows = append(rows, []string{strings.TrimSuffix(table, "s"), "reads"})
+		for _, b := range list {
+			rows = append(rows, []string{b.Name, strconv.Itoa(b.Reads)})
+		}
+	default:
+		table = "series"
+		rows = append(rows, []string{report.Bucket, "reads", "readers"})
+		for _, p := range report.Series {
+			rows = append(rows, []string{p.Period, strconv.Itoa(p.Reads), strconv.Itoa(p.Readers)})
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s-%s.csv"`, table, report.From, report.To))
+
+	cw := csv.NewWriter(w)
+	cw.WriteAll(rows)
+}
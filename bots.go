@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type botKey struct{}
+
+// botAgents matches User-Agents of crawlers, link previews, monitoring and
+// HTTP libraries.
+var botAgents = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|archiver|facebookexternalhit|embedly|preview|monitor|uptime|curl|wget|python|java/|go-http-client|okhttp|axios|node-fetch|libwww|httpclient|scrapy|headless|phantomjs|puppeteer|playwright|selenium|lighthouse`)
+
+// botFilter classifies requests as bots and keeps counts of what was
+// filtered, so crawlers do not inflate view_count, read_count or Viewer
+// data.
+//
+// The rate limit is per client IP. Behind a reverse proxy TRUST_PROXY must
+// list the proxies, or every visitor shares the proxy's address and one
+// limit; a warning is logged when that looks to be the case.
+type botFilter struct {
+	limit   int
+	window  time.Duration
+	proxies []*net.IPNet
+
+	mu        sync.Mutex
+	hits      map[string][]time.Time
+	pruned    time.Time
+	filtered  map[string]int64
+	warnProxy sync.Once
+}
+
+func newBotFilter(limit int, window time.Duration, proxies []*net.IPNet) *botFilter {
+	return &botFilter{
+		limit:    limit,
+		window:   window,
+		proxies:  proxies,
+		hits:     map[string][]time.Time{},
+		filtered: map[string]int64{},
+	}
+}
+
+// parseProxies reads a comma separated list of proxy addresses and
+// networks, such as "127.0.0.1,10.0.0.0/8".
+func parseProxies(list string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy %q: %w", s, err)
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+func (bf *botFilter) trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range bf.proxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address the request came from. X-Forwarded-For is only
+// read when the request came through a trusted proxy, and then from the
+// right: the first address that is not a trusted proxy is the client, the
+// ones to the left of it can be made up by anyone.
+func (bf *botFilter) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	fwd := r.Header.Get("X-Forwarded-For")
+	if len(bf.proxies) == 0 {
+		if fwd != "" {
+			bf.warnProxy.Do(func() {
+				log.Printf("Requests from %s carry X-Forwarded-For but TRUST_PROXY is not set, all visitors through it share one rate limit", ip)
+			})
+		}
+		return ip
+	}
+	if fwd == "" || !bf.trusted(ip) {
+		return ip
+	}
+
+	hops := strings.Split(fwd, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !bf.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// overLimit records a hit from ip and reports whether it made more than
+// limit requests within the window. At most limit+1 hits are kept per ip,
+// and idle ips are dropped once per window rather than on every call, so
+// a flood costs the same per request as normal traffic.
+func (bf *botFilter) overLimit(ip string, now time.Time) bool {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+
+	cutoff := now.Add(-bf.window)
+	hits := bf.hits[ip]
+	i := 0
+	for i < len(hits) && hits[i].Before(cutoff) {
+		i++
+	}
+	if n := len(hits) - i; n > bf.limit {
+		i += n - bf.limit
+	}
+	hits = append(hits[i:], now)
+	bf.hits[ip] = hits
+
+	if now.Sub(bf.pruned) >= bf.window {
+		bf.pruned = now
+		for k, h := range bf.hits {
+			if h[len(h)-1].Before(cutoff) {
+				delete(bf.hits, k)
+			}
+		}
+	}
+
+	return len(hits) > bf.limit
+}
+
+// classify returns why a request looks automated, or an empty string.
+func (bf *botFilter) classify(r *http.Request) string {
+	ua := r.UserAgent()
+
+	switch {
+	case ua == "":
+		return "no-user-agent"
+	case botAgents.MatchString(ua):
+		return "user-agent"
+	case strings.Contains(r.Header.Get("Sec-Ch-Ua"), "HeadlessChrome"):
+		return "headless"
+	case r.Header.Get("Accept-Language") == "":
+		// Every real browser sends it, most scripted clients do not.
+		return "headless"
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/read/") {
+		parts := strings.SplitN(r.URL.Path, "/", 5)
+		if len(parts) < 4 || !validUuid(parts[3]) {
+			return "no-uuid"
+		}
+	}
+
+	if bf.overLimit(bf.clientIP(r), time.Now()) {
+		return "rate"
+	}
+
+	return ""
+}
+
+func (bf *botFilter) count(what string) {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+
+	bf.filtered[what]++
+}
+
+func (bf *botFilter) counts() map[string]int64 {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+
+	out := map[string]int64{}
+	for k, v := range bf.filtered {
+		out[k] = v
+	}
+	return out
+}
+
+// classifyRequests marks requests from bots in their context. Static files
+// are not classified and do not count towards the rate limit.
+func (app *application) classifyRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/static/") || r.URL.Path == "/favicon.ico" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if reason := app.bots.classify(r); reason != "" {
+			app.bots.count("requests/" + reason)
+			r = r.WithContext(context.WithValue(r.Context(), botKey{}, reason))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isBot(ctx context.Context) bool {
+	reason, _ := ctx.Value(botKey{}).(string)
+	return reason != ""
+}
+
+// countViews adds the shown cards to the view counts and to the
+// impressions of their sources, unless the request came from a bot.
+func (app *application) countViews(ctx context.Context, content []DGraphContent) {
+	if isBot(ctx) {
+		app.bots.count("views")
+		return
+	}
+	app.views.add(content)
+	app.clicks.impressions(content)
+}
+
+// trafficStats lists how much bot traffic has been filtered since start.
+func (app *application) trafficStats(w http.ResponseWriter, r *http.Request) {
+	pb, err := json.Marshal(app.bots.counts())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(pb)
+}
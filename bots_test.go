@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseProxies("127.0.0.1, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	behind := newBotFilter(120, time.Minute, proxies)
+	direct := newBotFilter(120, time.Minute, nil)
+
+	tests := []struct {
+		name   string
+		bf     *botFilter
+		remote string
+		fwd    string
+		want   string
+	}{
+		{"no proxy", direct, "203.0.113.9:5000", "", "203.0.113.9"},
+		{"forwarded header ignored without TRUST_PROXY", direct, "203.0.113.9:5000", "198.51.100.1", "203.0.113.9"},
+		{"through proxy", behind, "127.0.0.1:5000", "198.51.100.1", "198.51.100.1"},
+		{"spoofed leftmost entry", behind, "127.0.0.1:5000", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		{"chain of proxies", behind, "127.0.0.1:5000", "1.2.3.4, 198.51.100.1, 10.1.2.3", "198.51.100.1"},
+		{"header from untrusted peer", behind, "203.0.113.9:5000", "198.51.100.1", "203.0.113.9"},
+		{"garbage in header", behind, "127.0.0.1:5000", "nonsense", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.fwd != "" {
+			r.Header.Set("X-Forwarded-For", tt.fwd)
+		}
+		if got := tt.bf.clientIP(r); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := parseProxies("not-an-ip"); err == nil {
+		t.Error("parseProxies accepted a bad address")
+	}
+}
+
+func TestOverLimit(t *testing.T) {
+	bf := newBotFilter(3, time.Minute, nil)
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		if bf.overLimit("198.51.100.1", start.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("hit %d over the limit", i+1)
+		}
+	}
+	for i := 3; i < 100; i++ {
+		if !bf.overLimit("198.51.100.1", start.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("hit %d under the limit", i+1)
+		}
+	}
+	if n := len(bf.hits["198.51.100.1"]); n != 4 {
+		t.Errorf("kept %d hits, want limit+1", n)
+	}
+
+	// Another ip is not affected, and after a quiet window the first one
+	// is forgotten.
+	if bf.overLimit("198.51.100.2", start.Add(100*time.Second)) {
+		t.Error("second ip over the limit")
+	}
+	later := start.Add(100*time.Second + 2*time.Minute)
+	if bf.overLimit("198.51.100.3", later) {
+		t.Error("third ip over the limit")
+	}
+	if _, ok := bf.hits["198.51.100.1"]; ok {
+		t.Error("idle ip not pruned after a window")
+	}
+	if bf.overLimit("198.51.100.1", later) {
+		t.Error("first ip still over the limit after a quiet window")
+	}
+}
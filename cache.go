@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type cached[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// ttlCache keeps loaded values for a while, so expensive queries are not
+// run for every request.
+type ttlCache[V any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cached[V]
+}
+
+func newTTLCache[V any](ttl time.Duration) *ttlCache[V] {
+	return &ttlCache[V]{ttl: ttl, entries: map[string]cached[V]{}}
+}
+
+// get returns the cached value for key, calling load if it is missing or
+// expired. Failed loads are not cached.
+func (tc *ttlCache[V]) get(key string, load func() (V, error)) (V, error) {
+	now := time.Now()
+
+	tc.mu.Lock()
+	e, ok := tc.entries[key]
+	tc.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.value, nil
+	}
+
+	value, err := load()
+	if err != nil {
+		return value, err
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for k, e := range tc.entries {
+		if now.After(e.expires) {
+			delete(tc.entries, k)
+		}
+	}
+	tc.entries[key] = cached[V]{value, now.Add(tc.ttl)}
+
+	return value, nil
+}
+
+// poolCache keeps candidate pools so rotating what is shown does not need
+// a query per page view.
+type poolCache = ttlCache[[]DGraphContent]
+
+func newPoolCache(ttl time.Duration) *poolCache {
+	return newTTLCache[[]DGraphContent](ttl)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sources of the cards on the start page and in the "load more" list. The
+// content page uses the recommender names.
+const (
+	sourceStart  = "start"
+	sourceRootsy = "rootsy"
+	sourceExtra  = "extra"
+)
+
+// maxPosition is the highest card position accepted from the beacon.
+const maxPosition = 100
+
+type ctrCount struct {
+	Impressions int64 `json:"impressions"`
+	Clicks      int64 `json:"clicks"`
+}
+
+// clickStats counts impressions and clicks per recommendation source, per
+// day and per card position, and is saved to a JSON file.
+type clickStats struct {
+	mu   sync.Mutex
+	path string
+
+	Days      map[string]map[string]*ctrCount `json:"days"`
+	Positions map[string]map[int]*ctrCount    `json:"positions"`
+}
+
+func loadClickStats(path string) (*clickStats, error) {
+	cs := &clickStats{
+		path:      path,
+		Days:      map[string]map[string]*ctrCount{},
+		Positions: map[string]map[int]*ctrCount{},
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, cs)
+	if err != nil {
+		return nil, err
+	}
+
+	return cs, nil
+}
+
+func (cs *clickStats) counters(source string, pos int) (*ctrCount, *ctrCount) {
+	day := time.Now().Format(dateFormat)
+	if cs.Days[day] == nil {
+		cs.Days[day] = map[string]*ctrCount{}
+	}
+	if cs.Days[day][source] == nil {
+		cs.Days[day][source] = &ctrCount{}
+	}
+	if cs.Positions[source] == nil {
+		cs.Positions[source] = map[int]*ctrCount{}
+	}
+	if cs.Positions[source][pos] == nil {
+		cs.Positions[source][pos] = &ctrCount{}
+	}
+	return cs.Days[day][source], cs.Positions[source][pos]
+}
+
+// impressions records that the cards were shown, in the order given.
+func (cs *clickStats) impressions(content []DGraphContent) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for pos, c := range content {
+		if c.Reason == "" || pos > maxPosition {
+			continue
+		}
+		day, position := cs.counters(c.Reason, pos)
+		day.Impressions++
+		position.Impressions++
+	}
+}
+
+func (cs *clickStats) click(source string, pos int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	day, position := cs.counters(source, pos)
+	day.Clicks++
+	position.Clicks++
+}
+
+// save writes the counts to a temporary file and renames it into place.
+func (cs *clickStats) save() error {
+	cs.mu.Lock()
+	b, err := json.Marshal(cs)
+	cs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := cs.path + ".tmp"
+	err = os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, cs.path)
+}
+
+func (app *application) saveClicks(ctx context.Context) error {
+	return app.clicks.save()
+}
+
+func validSource(source string) bool {
+	if _, ok := recommenders[source]; ok {
+		return true
+	}
+	return source == sourceStart || source == sourceRootsy || source == sourceExtra
+}
+
+// click is the beacon sent when a card is followed.
+func (app *application) click(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	source := r.PostFormValue("src")
+	pos, err := strconv.Atoi(r.PostFormValue("pos"))
+	if !validSource(source) || err != nil || pos < 0 || pos > maxPosition {
+		http.Error(w, "Bad click", http.StatusBadRequest)
+		return
+	}
+
+	if isBot(r.Context()) {
+		app.bots.count("clicks")
+	} else {
+		app.clicks.click(source, pos)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type SourceCtr struct {
+	Source      string
+	Impressions int64
+	Clicks      int64
+	Ctr         string
+	Positions   []PositionCtr
+}
+
+type PositionCtr struct {
+	Position    int
+	Impressions int64
+	Clicks      int64
+	Ctr         string
+}
+
+type PrintClicks struct {
+	Days    int
+	Sources []SourceCtr
+}
+
+func ctr(clicks, impressions int64) string {
+	if impressions == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(100*float64(clicks)/float64(impressions), 'f', 2, 64) + "%"
+}
+
+// clickReport shows the click-through rate per recommendation source over
+// the last days, and per card position since counting started.
+func (app *application) clickReport(w http.ResponseWriter, r *http.Request) {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+	since := time.Now().AddDate(0, 0, -days).Format(dateFormat)
+
+	app.clicks.mu.Lock()
+	totals := map[string]*ctrCount{}
+	for day, sources := range app.clicks.Days {
+		if day < since {
+			continue
+		}
+		for source, c := range sources {
+			if totals[source] == nil {
+				totals[source] = &ctrCount{}
+			}
+			totals[source].Impressions += c.Impressions
+			totals[source].Clicks += c.Clicks
+		}
+	}
+
+	report := PrintClicks{Days: days}
+	for source, c := range totals {
+		s := SourceCtr{
+			Source:      source,
+			Impressions: c.Impressions,
+			Clicks:      c.Clicks,
+			Ctr:         ctr(c.Clicks, c.Impressions),
+		}
+		for pos, p := range app.clicks.Positions[source] {
+			s.Positions = append(s.Positions, PositionCtr{pos, p.Impressions, p.Clicks, ctr(p.Clicks, p.Impressions)})
+		}
+		sort.Slice(s.Positions, func(i, j int) bool {
+			return s.Positions[i].Position < s.Positions[j].Position
+		})
+		report.Sources = append(report.Sources, s)
+	}
+	app.clicks.mu.Unlock()
+
+	sort.Slice(report.Sources, func(i, j int) bool {
+		return report.Sources[i].Source < report.Sources[j].Source
+	})
+
+	app.executeTemplate(w, "clicks", report)
+}
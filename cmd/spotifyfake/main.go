@@ -0,0 +1,96 @@
+// Command spotifyfake serves a fake Spotify for running rootsy locally:
+//
+//	go run ./cmd/spotifyfake -addr 127.0.0.1:9191
+//	SPOTIFY_ACCOUNTS_URL=http://127.0.0.1:9191 SPOTIFY_API_URL=http://127.0.0.1:9191 \
+//	SPOTIFY_KEY=fake SPOTIFY_SECRET=fake go run .
+//
+// Visiting /admin/spotify/connect is approved at once, after which
+// playlist sync can change the playlists.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/jsol/rootsy-dgraph/spotifyfake"
+)
+
+// defaultSeed has a playlist to sync, a few albums to match and a long
+// compilation for paging.
+func defaultSeed() spotifyfake.Seed {
+	compilation := []string{}
+	for i := 1; i <= 130; i++ {
+		compilation = append(compilation, fmt.Sprintf("comp%03d", i))
+	}
+
+	return spotifyfake.Seed{
+		Albums: []spotifyfake.Album{
+			{
+				ID:          "34xaLN7rDecGEK5UGIVbeJ",
+				Name:        "Nebraska",
+				Artists:     []string{"Bruce Springsteen"},
+				ReleaseDate: "1982-09-30",
+				Images:      []spotifyfake.Image{{URL: "https://i.scdn.co/image/nebraska", Height: 640, Width: 640}},
+				Tracks:      []string{"neb01", "neb02", "neb03", "neb04", "neb05", "neb06", "neb07", "neb08", "neb09", "neb10"},
+			},
+			{
+				ID:          "4u7fGrBdS8EUoGbUuvo1Ch",
+				Name:        "Nebraska (Deluxe Edition)",
+				Artists:     []string{"Bruce Springsteen"},
+				ReleaseDate: "2025-10-17",
+				Tracks:      []string{"nebd01", "nebd02"},
+			},
+			{
+				ID:          "0sNOF9WDwhWunNAHPD3Baj",
+				Name:        "Sånger från en stad",
+				Artists:     []string{"Åsa Öberg"},
+				ReleaseDate: "2019-03-01",
+				Markets:     []string{"SE"},
+				Images:      []spotifyfake.Image{{URL: "https://i.scdn.co/image/sanger", Height: 640, Width: 640}},
+				Tracks:      []string{"asa01", "asa02", "asa03"},
+			},
+			{
+				ID:        "6dVIqQ8qmQ5GBnJ9shOYGE",
+				Name:      "Americana Sampler",
+				Artists:   []string{"Various Artists"},
+				AlbumType: "compilation",
+				Tracks:    compilation,
+			},
+		},
+		Playlists: map[string][]string{
+			"39kgihD6NPmYjAKM8wKCoM": {"spotify:track:old01", "spotify:track:old02"},
+		},
+	}
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9191", "address to listen on")
+	id := flag.String("id", "fake", "client id to accept")
+	secret := flag.String("secret", "fake", "client secret to accept")
+	seedPath := flag.String("seed", "", "JSON file with albums and playlists, instead of the built-in ones")
+	flag.Parse()
+
+	seed := defaultSeed()
+	if *seedPath != "" {
+		b, err := os.ReadFile(*seedPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		seed = spotifyfake.Seed{}
+		err = json.Unmarshal(b, &seed)
+		if err != nil {
+			log.Fatalln(*seedPath+":", err)
+		}
+	}
+
+	fake := spotifyfake.New(*id, *secret)
+	fake.SetBaseURL("http://" + *addr)
+	fake.Load(seed)
+
+	log.Printf("Fake Spotify on http://%s with %d albums and %d playlists", *addr, len(seed.Albums), len(seed.Playlists))
+	log.Fatal(http.ListenAndServe(*addr, fake))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+const (
+	// coreadNeighbours is how many co-read edges are kept per content.
+	coreadNeighbours = 20
+	// coreadPerViewer caps how many reads of a single viewer are paired, so
+	// one very active uuid cannot dominate the counts.
+	coreadPerViewer = 50
+	coreadPageSize  = 1000
+)
+
+type ViewerReads struct {
+	Uid     string `json:"uid"`
+	Content []struct {
+		Uid string `json:"uid"`
+	} `json:"content"`
+}
+
+type ViewerReadsResponse struct {
+	Viewers []ViewerReads `json:"viewers"`
+}
+
+// computeCoread counts, for every pair of content, how many viewers read
+// both, and stores the most frequent pairs as coread edges with the count
+// as a facet. Only the latest coreadPerViewer reads of each viewer count.
+func (app *application) computeCoread(ctx context.Context) error {
+	dc := api.NewDgraphClient(app.conn)
+	dg := dgo.NewDgraphClient(dc)
+
+	pairs := map[string]map[string]float64{}
+
+	q := `query Viewers($after: string, $first: int) {
+		viewers(func: type(Viewer), first: $first, after: $after) {
+			uid
+			content (first: ` + fmt.Sprint(coreadPerViewer) + `) @facets(orderdesc: time) {
+				uid
+			}
+		}
+	}`
+
+	after := "0x0"
+	for {
+		txn := dg.NewReadOnlyTxn()
+		res, err := txn.QueryWithVars(ctx, q, map[string]string{"$after": after, "$first": fmt.Sprint(coreadPageSize)})
+		txn.Discard(ctx)
+		if err != nil {
+			return err
+		}
+
+		var resp ViewerReadsResponse
+		err = json.Unmarshal(res.Json, &resp)
+		if err != nil {
+			return err
+		}
+
+		for _, v := range resp.Viewers {
+			for i, a := range v.Content {
+				for _, b := range v.Content[i+1:] {
+					if a.Uid == b.Uid {
+						continue
+					}
+					addPair(pairs, a.Uid, b.Uid)
+					addPair(pairs, b.Uid, a.Uid)
+				}
+			}
+		}
+
+		if len(resp.Viewers) < coreadPageSize {
+			break
+		}
+		after = resp.Viewers[len(resp.Viewers)-1].Uid
+	}
+
+	edges := map[string][]scoredEdge{}
+	for uid, counts := range pairs {
+		edges[uid] = topEdges(counts, coreadNeighbours)
+	}
+
+	return replaceEdges(ctx, dg, "coread", "count", edges)
+}
+
+func addPair(pairs map[string]map[string]float64, a, b string) {
+	if pairs[a] == nil {
+		pairs[a] = map[string]float64{}
+	}
+	pairs[a][b]++
+}
+
+func extraContent(c DGraphContent) ExtraContent {
+	writer := ""
+	if len(c.WrittenBy) > 0 {
+		writer = c.WrittenBy[0].Name
+	}
+
+	return ExtraContent{
+		Name:       c.Name,
+		Uid:        c.Uid,
+		Url:        contentPath(c.Uid, c.Name),
+		LeadInText: string(clearMarkers(c.LeadInText)),
+		Pic:        c.Pic,
+		Type:       c.Type,
+		TypeText:   typeText(c.Type),
+		WrittenBy:  writer,
+		Source:     c.Reason,
+	}
+}
+
+// apiRelatedContent returns what readers of /api/content/related/{uid}
+// also read.
+func (app *application) apiRelatedContent(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	uid := strings.TrimPrefix(r.URL.Path, "/api/content/related/")
+	if !validUid(uid) {
+		http.NotFound(w, r)
+		return
+	}
+
+	dc := api.NewDgraphClient(app.conn)
+	dg := dgo.NewDgraphClient(dc)
+
+	found, err := recommenders["coread"].Candidates(ctx, dg, uid, 15)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Could not load related content", http.StatusInternalServerError)
+		return
+	}
+
+	list := []ExtraContent{}
+	for _, c := range found {
+		list = append(list, extraContent(c))
+	}
+
+	pb, err := json.Marshal(list)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(pb)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+const edgeBatchSize = 100
+
+// scoredEdge is a precomputed edge to uid, stored with score as a facet.
+type scoredEdge struct {
+	uid   string
+	score float64
+}
+
+type StaleResponse struct {
+	Stale []struct {
+		Uid string `json:"uid"`
+	} `json:"stale"`
+}
+
+// replaceEdges makes edges the only values of predicate. Nodes that have
+// the predicate today but are missing from edges lose all of theirs.
+func replaceEdges(ctx context.Context, dg *dgo.Dgraph, predicate, facet string, edges map[string][]scoredEdge) error {
+	err := dg.Alter(ctx, &api.Operation{Schema: predicate + `: [uid] .`})
+	if err != nil {
+		return err
+	}
+
+	txn := dg.NewReadOnlyTxn()
+	res, err := txn.Query(ctx, `{ stale(func: has(`+predicate+`)) { uid } }`)
+	txn.Discard(ctx)
+	if err != nil {
+		return err
+	}
+
+	var resp StaleResponse
+	err = json.Unmarshal(res.Json, &resp)
+	if err != nil {
+		return err
+	}
+
+	touched := map[string]bool{}
+	for _, s := range resp.Stale {
+		touched[s.Uid] = true
+	}
+	for uid := range edges {
+		touched[uid] = true
+	}
+
+	uids := make([]string, 0, len(touched))
+	for uid := range touched {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	for len(uids) > 0 {
+		n := edgeBatchSize
+		if n > len(uids) {
+			n = len(uids)
+		}
+
+		del, set := edgeNquads(uids[:n], predicate, facet, edges)
+		uids = uids[n:]
+
+		mutations := []*api.Mutation{{DelNquads: []byte(del)}}
+		if set != "" {
+			mutations = append(mutations, &api.Mutation{SetNquads: []byte(set)})
+		}
+
+		txn := dg.NewTxn()
+		_, err := txn.Do(ctx, &api.Request{Mutations: mutations, CommitNow: true})
+		txn.Discard(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// edgeNquads returns the nquads deleting all predicate edges of uids and
+// setting the ones in edges.
+func edgeNquads(uids []string, predicate, facet string, edges map[string][]scoredEdge) (del, set string) {
+	var d, s strings.Builder
+	for _, uid := range uids {
+		fmt.Fprintf(&d, "<%s> <%s> * .\n", uid, predicate)
+		for _, e := range edges[uid] {
+			fmt.Fprintf(&s, "<%s> <%s> <%s> (%s=%s) .\n", uid, predicate, e.uid, facet, facetFloat(e.score))
+		}
+	}
+	return d.String(), s.String()
+}
+
+// facetFloat formats v so Dgraph always stores a float facet; without a
+// decimal point 1 would become an int.
+func facetFloat(v float64) string {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+// topEdges returns the n highest scoring edges, ties broken by uid so runs
+// are stable.
+func topEdges(scores map[string]float64, n int) []scoredEdge {
+	list := make([]scoredEdge, 0, len(scores))
+	for uid, score := range scores {
+		list = append(list, scoredEdge{uid, score})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].score != list[j].score {
+			return list[i].score > list[j].score
+		}
+		return list[i].uid < list[j].uid
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
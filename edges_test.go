@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestFacetFloat(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0.0"},
+		{1, "1.0"},
+		{20, "20.0"},
+		{0.25, "0.25"},
+		{0.123, "0.123"},
+		{1e-7, "0.0000001"},
+		{1e21, "1000000000000000000000.0"},
+	}
+	for _, tt := range tests {
+		if got := facetFloat(tt.v); got != tt.want {
+			t.Errorf("facetFloat(%v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestEdgeNquads(t *testing.T) {
+	edges := map[string][]scoredEdge{
+		"0x1": {{"0x3", 1}, {"0x4", 0.25}},
+		"0x5": {{"0x1", 3}},
+	}
+
+	tests := []struct {
+		name     string
+		uids     []string
+		del, set string
+	}{
+		{
+			name: "edges replaced",
+			uids: []string{"0x1"},
+			del:  "<0x1> <similar> * .\n",
+			set:  "<0x1> <similar> <0x3> (score=1.0) .\n<0x1> <similar> <0x4> (score=0.25) .\n",
+		},
+		{
+			name: "stale node only loses its edges",
+			uids: []string{"0x2"},
+			del:  "<0x2> <similar> * .\n",
+			set:  "",
+		},
+		{
+			name: "batch",
+			uids: []string{"0x2", "0x5"},
+			del:  "<0x2> <similar> * .\n<0x5> <similar> * .\n",
+			set:  "<0x5> <similar> <0x1> (score=3.0) .\n",
+		},
+	}
+	for _, tt := range tests {
+		del, set := edgeNquads(tt.uids, "similar", "score", edges)
+		if del != tt.del {
+			t.Errorf("%s: del = %q, want %q", tt.name, del, tt.del)
+		}
+		if set != tt.set {
+			t.Errorf("%s: set = %q, want %q", tt.name, set, tt.set)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+type variantKey struct{}
+
+// uuidCookie carries the sessionStorage uuid to the server. header.tmpl
+// sets it, so the first page of a session is served without a variant.
+const uuidCookie = "uuid"
+
+// Variant is one arm of an experiment. Fields left out use the defaults.
+type Variant struct {
+	Name  string `json:"name"`
+	Share int    `json:"share"`
+	// Weights are recommender weights for the content page, see
+	// RECOMMEND_WEIGHTS.
+	Weights string `json:"weights"`
+	// StartExtra cards come from the extra pool on the start page, which is
+	// then filled up to StartTotal from the rootsy pool.
+	StartExtra int `json:"start_extra"`
+	StartTotal int `json:"start_total"`
+
+	recommender *RecommendEngine
+}
+
+// Experiment splits clients between variants by their uuid.
+type Experiment struct {
+	Name     string    `json:"name"`
+	Variants []Variant `json:"variants"`
+
+	shares int
+}
+
+// loadExperiment reads the experiment from a JSON file. A missing file
+// means no experiment is running.
+func loadExperiment(path string, pools *poolCache, weight func(DGraphContent) float64) (*Experiment, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var e Experiment
+	err = json.Unmarshal(b, &e)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if e.Name == "" || len(e.Variants) == 0 {
+		return nil, fmt.Errorf("%s: an experiment needs a name and variants", path)
+	}
+
+	seen := map[string]bool{}
+	for i := range e.Variants {
+		v := &e.Variants[i]
+		if v.Name == "" || seen[v.Name] || strings.ContainsAny(v.Name, "/ ") {
+			return nil, fmt.Errorf("%s: bad or repeated variant name %q", path, v.Name)
+		}
+		seen[v.Name] = true
+		if v.Share <= 0 {
+			v.Share = 1
+		}
+		e.shares += v.Share
+
+		if v.Weights != "" {
+			v.recommender, err = NewRecommendEngine(v.Weights, 16, pools, weight)
+			if err != nil {
+				return nil, fmt.Errorf("%s: variant %s: %w", path, v.Name, err)
+			}
+		}
+	}
+
+	return &e, nil
+}
+
+// assign picks the variant of uuid. The hash includes the experiment name
+// so clients are shuffled anew for every experiment.
+func (e *Experiment) assign(uuid string) *Variant {
+	if e == nil || !validUuid(uuid) {
+		return nil
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + "|" + uuid))
+	n := int(h.Sum32() % uint32(e.shares))
+	for i := range e.Variants {
+		n -= e.Variants[i].Share
+		if n < 0 {
+			return &e.Variants[i]
+		}
+	}
+	return nil
+}
+
+// label is what reads are tagged with: experiment and variant.
+func (e *Experiment) label(v *Variant) string {
+	if v == nil {
+		return ""
+	}
+	return e.Name + "/" + v.Name
+}
+
+// assignVariants puts the variant of the client in the request context.
+func (app *application) assignVariants(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.experiment != nil {
+			if c, err := r.Cookie(uuidCookie); err == nil {
+				if v := app.experiment.assign(c.Value); v != nil {
+					r = r.WithContext(context.WithValue(r.Context(), variantKey{}, v))
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func variantFrom(ctx context.Context) *Variant {
+	v, _ := ctx.Value(variantKey{}).(*Variant)
+	return v
+}
+
+// recommenderFor is the engine of the variant, or the default one.
+func (app *application) recommenderFor(ctx context.Context) *RecommendEngine {
+	if v := variantFrom(ctx); v != nil && v.recommender != nil {
+		return v.recommender
+	}
+	return app.recommender
+}
+
+// startMix is how many start page cards come from the extra pool and how
+// many there are in all.
+func startMix(ctx context.Context) (int, int) {
+	extra, total := 15, 20
+	if v := variantFrom(ctx); v != nil {
+		if v.StartExtra > 0 {
+			extra = v.StartExtra
+		}
+		if v.StartTotal > 0 {
+			total = v.StartTotal
+		}
+	}
+	if extra > total {
+		extra = total
+	}
+	return extra, total
+}
+
+type VariantEdge struct {
+	Uid     string    `json:"uid"`
+	Time    time.Time `json:"content|time"`
+	Variant string    `json:"content|variant"`
+}
+
+type VariantNode struct {
+	Uid     string        `json:"uid"`
+	Content []VariantEdge `json:"content"`
+}
+
+type VariantNodeResponse struct {
+	Viewers []VariantNode `json:"viewers"`
+}
+
+// VariantResult compares a variant on the reads tagged with it. Read
+// through is the share of readers that went on to read a second piece.
+type VariantResult struct {
+	Variant        string
+	Readers        int
+	Reads          int
+	ReadsPerReader string
+	ReadThrough    string
+}
+
+type PrintExperiment struct {
+	Name     string
+	From     string
+	To       string
+	Variants []VariantResult
+}
+
+// variantReads counts, per viewer, the reads in [from, to) tagged with a
+// variant of the experiment.
+func variantReads(ctx context.Context, dg *dgo.Dgraph, experiment string, from, to time.Time) (map[string]map[string]int, error) {
+	q := `query Reads($after: string, $first: int) {
+		viewers(func: type(Viewer), first: $first, after: $after) {
+			uid
+			content @facets(ge(time, "` + from.UTC().Format(time.RFC3339) + `") AND lt(time, "` + to.UTC().Format(time.RFC3339) + `")) @facets(time, variant) {
+				uid
+			}
+		}
+	}`
+
+	perVariant := map[string]map[string]int{}
+	after := "0x0"
+	for {
+		txn := dg.NewReadOnlyTxn()
+		res, err := txn.QueryWithVars(ctx, q, map[string]string{"$after": after, "$first": fmt.Sprint(readsPageSize)})
+		txn.Discard(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var resp VariantNodeResponse
+		err = json.Unmarshal(res.Json, &resp)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range resp.Viewers {
+			for _, c := range v.Content {
+				name, ok := strings.CutPrefix(c.Variant, experiment+"/")
+				if !ok {
+					continue
+				}
+				if perVariant[name] == nil {
+					perVariant[name] = map[string]int{}
+				}
+				perVariant[name][v.Uid]++
+			}
+		}
+
+		if len(resp.Viewers) < readsPageSize {
+			break
+		}
+		after = resp.Viewers[len(resp.Viewers)-1].Uid
+	}
+
+	return perVariant, nil
+}
+
+func percent(n, of int) string {
+	if of == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(of))
+}
+
+// experimentReport shows read-through per variant of the running
+// experiment, as HTML or with format=json.
+func (app *application) experimentReport(w http.ResponseWriter, r *http.Request) {
+	if app.experiment == nil {
+		http.Error(w, "No experiment is running", http.StatusNotFound)
+		return
+	}
+
+	from, to, err := dateRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dc := api.NewDgraphClient(app.conn)
+	dg := dgo.NewDgraphClient(dc)
+
+	perVariant, err := variantReads(r.Context(), dg, app.experiment.Name, from, to)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Could not compute experiment", http.StatusInternalServerError)
+		return
+	}
+
+	report := PrintExperiment{
+		Name: app.experiment.Name,
+		From: from.Format(dateFormat),
+		To:   to.AddDate(0, 0, -1).Format(dateFormat),
+	}
+	for _, v := range app.experiment.Variants {
+		res := VariantResult{Variant: v.Name}
+		through := 0
+		for _, n := range perVariant[v.Name] {
+			res.Readers++
+			res.Reads += n
+			if n > 1 {
+				through++
+			}
+		}
+		res.ReadThrough = percent(through, res.Readers)
+		res.ReadsPerReader = "-"
+		if res.Readers > 0 {
+			res.ReadsPerReader = fmt.Sprintf("%.2f", float64(res.Reads)/float64(res.Readers))
+		}
+		report.Variants = append(report.Variants, res)
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		pb, err := json.Marshal(report)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(pb)
+		return
+	}
+
+	app.executeTemplate(w, "experiment", report)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// schedule runs job every interval until the process exits. Errors are
+// logged and the job is tried again at the next tick.
+func (app *application) schedule(name string, interval time.Duration, job func(ctx context.Context) error) {
+	app.startJob(name, interval, false, job)
+}
+
+// scheduleNow is schedule for jobs whose result is needed before the first
+// tick: job also runs once at start.
+func (app *application) scheduleNow(name string, interval time.Duration, job func(ctx context.Context) error) {
+	app.startJob(name, interval, true, job)
+}
+
+func (app *application) startJob(name string, interval time.Duration, now bool, job func(ctx context.Context) error) {
+	if interval <= 0 {
+		log.Printf("Job %s disabled", name)
+		return
+	}
+
+	run := func() {
+		start := time.Now()
+		err := job(context.Background())
+		if err != nil {
+			log.Printf("Job %s failed: %v", name, err)
+			return
+		}
+		log.Printf("Job %s done in %s", name, time.Since(start))
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		if now {
+			run()
+		}
+		for range ticker.C {
+			run()
+		}
+	}()
+}
+
+// envInt reads a number from the environment.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+
+	return n
+}
+
+// envDuration reads a duration such as "6h" from the environment.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+
+	return d
+}
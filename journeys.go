@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+// sessionGap splits the reads of one viewer into sessions. A tab kept open
+// overnight is two sessions.
+const sessionGap = 30 * time.Minute
+
+type Transition struct {
+	From     string `json:"from"`
+	FromName string `json:"from_name"`
+	To       string `json:"to"`
+	ToName   string `json:"to_name"`
+	Count    int    `json:"count"`
+}
+
+type TypeTransition struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Count int    `json:"count"`
+}
+
+type LengthBucket struct {
+	Reads    string `json:"reads"`
+	Sessions int    `json:"sessions"`
+	// Width is Sessions in percent of the largest bucket, for the bar chart.
+	Width int `json:"-"`
+}
+
+type JourneyReport struct {
+	From            string           `json:"from"`
+	To              string           `json:"to"`
+	Sessions        int              `json:"sessions"`
+	Transitions     []Transition     `json:"transitions"`
+	TypeTransitions []TypeTransition `json:"type_transitions"`
+	Lengths         []LengthBucket   `json:"session_lengths"`
+}
+
+// lengthBuckets are the upper bounds of the session length buckets; the
+// last one is open.
+var lengthBuckets = []int{1, 2, 3, 4, 5, 10}
+
+func lengthBucket(n int) int {
+	for i, max := range lengthBuckets {
+		if n <= max {
+			return i
+		}
+	}
+	return len(lengthBuckets)
+}
+
+func lengthLabels() []string {
+	labels := []string{}
+	low := 1
+	for _, max := range lengthBuckets {
+		if low == max {
+			labels = append(labels, fmt.Sprint(max))
+		} else {
+			labels = append(labels, fmt.Sprintf("%d-%d", low, max))
+		}
+		low = max + 1
+	}
+	return append(labels, fmt.Sprintf("%d+", low))
+}
+
+// sessions groups reads per viewer in time order and splits them where
+// more than sessionGap passes between two reads.
+func sessions(reads []viewerRead) [][]viewerRead {
+	byViewer := map[string][]viewerRead{}
+	for _, r := range reads {
+		byViewer[r.viewer] = append(byViewer[r.viewer], r)
+	}
+
+	out := [][]viewerRead{}
+	for _, list := range byViewer {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].time.Before(list[j].time)
+		})
+		start := 0
+		for i := 1; i <= len(list); i++ {
+			if i == len(list) || list[i].time.Sub(list[i-1].time) > sessionGap {
+				out = append(out, list[start:i])
+				start = i
+			}
+		}
+	}
+	return out
+}
+
+func buildJourneys(reads []viewerRead, info map[string]DGraphStats, from, to time.Time, top int) JourneyReport {
+	report := JourneyReport{
+		From: from.Format(dateFormat),
+		To:   to.AddDate(0, 0, -1).Format(dateFormat),
+	}
+
+	known := []viewerRead{}
+	for _, r := range reads {
+		if _, ok := info[r.content]; ok {
+			known = append(known, r)
+		}
+	}
+
+	type pair struct{ from, to string }
+	pairs := map[pair]int{}
+	typePairs := map[pair]int{}
+	lengths := make([]int, len(lengthBuckets)+1)
+
+	for _, s := range sessions(known) {
+		report.Sessions++
+		lengths[lengthBucket(len(s))]++
+		for i := 1; i < len(s); i++ {
+			pairs[pair{s[i-1].content, s[i].content}]++
+			typePairs[pair{typeText(info[s[i-1].content].Type), typeText(info[s[i].content].Type)}]++
+		}
+	}
+
+	for p, n := range pairs {
+		report.Transitions = append(report.Transitions, Transition{
+			From:     p.from,
+			FromName: info[p.from].Name,
+			To:       p.to,
+			ToName:   info[p.to].Name,
+			Count:    n,
+		})
+	}
+	sort.Slice(report.Transitions, func(i, j int) bool {
+		a, b := report.Transitions[i], report.Transitions[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+	if len(report.Transitions) > top {
+		report.Transitions = report.Transitions[:top]
+	}
+
+	for p, n := range typePairs {
+		report.TypeTransitions = append(report.TypeTransitions, TypeTransition{p.from, p.to, n})
+	}
+	sort.Slice(report.TypeTransitions, func(i, j int) bool {
+		a, b := report.TypeTransitions[i], report.TypeTransitions[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+
+	max := 0
+	for _, n := range lengths {
+		if n > max {
+			max = n
+		}
+	}
+	for i, label := range lengthLabels() {
+		b := LengthBucket{Reads: label, Sessions: lengths[i]}
+		if max > 0 {
+			b.Width = lengths[i] * 100 / max
+		}
+		report.Lengths = append(report.Lengths, b)
+	}
+
+	return report
+}
+
+func (app *application) journeyReport(ctx context.Context, from, to time.Time) (JourneyReport, error) {
+	key := fmt.Sprintf("%s|%s", from.Format(dateFormat), to.Format(dateFormat))
+
+	return app.journeys.get(key, func() (JourneyReport, error) {
+		dc := api.NewDgraphClient(app.conn)
+		dg := dgo.NewDgraphClient(dc)
+
+		reads, err := loadReads(ctx, dg, from, to)
+		if err != nil {
+			return JourneyReport{}, err
+		}
+
+		seen := map[string]bool{}
+		uids := []string{}
+		for _, r := range reads {
+			if !seen[r.content] {
+				seen[r.content] = true
+				uids = append(uids, r.content)
+			}
+		}
+
+		info, err := loadContentInfo(ctx, dg, uids)
+		if err != nil {
+			return JourneyReport{}, err
+		}
+
+		return buildJourneys(reads, info, from, to, 50), nil
+	})
+}
+
+// journeyAnalytics shows what readers read next and how long sessions
+// are, as HTML or with format=json. Dgraph keeps one edge per viewer and
+// content, so a piece read twice in a session counts at its last read.
+func (app *application) journeyAnalytics(w http.ResponseWriter, r *http.Request) {
+	from, to, err := dateRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := app.journeyReport(r.Context(), from, to)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Could not compute journeys", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		pb, err := json.Marshal(report)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(pb)
+		return
+	}
+
+	app.executeTemplate(w, "journeys", report)
+}
@@ -7,13 +7,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"image"
 	"io"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	dgo "github.com/dgraph-io/dgo/v230"
@@ -35,13 +39,32 @@ type application struct {
 		key    string
 		secret string
 	}
-	port         int
-	sp           *Spotify
-	conn         *grpc.ClientConn
-	templates    *template.Template
-	debug        bool
-	StaticPath   string
-	TemplatePath string
+	port            int
+	sp              *Spotify
+	spUser          *Spotify
+	spotifyMarket   string
+	connects        *spotifyConnects
+	conn            *grpc.ClientConn
+	redirects       *redirectMap
+	recommender     *RecommendEngine
+	views           *viewCounter
+	readTokens      *readTokens
+	bots            *botFilter
+	reports         *ttlCache[AnalyticsReport]
+	journeys        *ttlCache[JourneyReport]
+	startTrending   int
+	clicks          *clickStats
+	experiment      *Experiment
+	viewerSalt      *viewerSalt
+	viewerRetention int
+	pools           *poolCache
+	thumbs          *ttlCache[image.Config]
+	legacyMisses    *legacyMisses
+	templates       *template.Template
+	debug           bool
+	baseURL         string
+	StaticPath      string
+	TemplatePath    string
 }
 
 type DGraphLink struct {
@@ -96,8 +119,11 @@ type DGraphContent struct {
 	Pic         string              `json:"pic"`
 	Pictext     string              `json:"picText"`
 	ViewCount   int                 `json:"view_count"`
+	ReadCount   int                 `json:"read_count"`
 	Type        string              `json:"type"`
 	DType       string              `json:"dgraph.type,omitempty"`
+	Reason      string              `json:"-"`
+	ReadToken   string              `json:"-"`
 	Content     []DGraphContent
 }
 
@@ -113,30 +139,38 @@ type DGraphStats struct {
 	DType     string              `json:"dgraph.type,omitempty"`
 }
 
-type Counter struct {
-	Name      string `json:"name"`
-	Uid       string `json:"uid"`
-	ReadCount int64  `json:"read_count"`
+type ViewerContent struct {
+	Uid     string `json:"uid"`
+	Time    string `json:"content|time"`
+	Variant string `json:"content|variant,omitempty"`
 }
 
-type Random struct {
-	Uid       string `json:"uid"`
-	Random    int    `json:"random"`
-	ViewCount int    `json:"view_count"`
+type ViewerRead struct {
+	Uid     string        `json:"uid"`
+	Uuid    string        `json:"uuid"`
+	DType   string        `json:"dgraph.type"`
+	Content ViewerContent `json:"content"`
 }
 
 type StatsResponse struct {
 	Stats []DGraphStats `json:"content"`
 }
 
-type CounterResponse struct {
-	Counter []Counter `json:"counter"`
-}
-
 type ArtistResponse struct {
 	Artist []DGraphArtist `json:"artist"`
 }
 
+type Listing struct {
+	Uid     string          `json:"uid"`
+	Name    string          `json:"name"`
+	Total   int             `json:"total"`
+	Content []DGraphContent `json:"content"`
+}
+
+type ListingResponse struct {
+	Listing []Listing `json:"listing"`
+}
+
 type ContentResponse struct {
 	Content []DGraphContent `json:"content"`
 	Extra   []DGraphContent `json:"extra"`
@@ -151,11 +185,32 @@ type ExtraContent struct {
 	Type       string `json:"type"`
 	TypeText   string `json:"type_text"`
 	WrittenBy  string `json:"written_by"`
+	Source     string `json:"source,omitempty"`
 }
 
-type UpdateSpotify struct {
-	Uid     string `json:"uid"`
-	Spotify string `json:"spotify"`
+type HeaderData struct {
+	Title      string
+	Canonical  string
+	OEmbedJson string
+	OEmbedXml  string
+}
+
+type PrintListing struct {
+	Name    string
+	Path    string
+	Links   []DGraphLink
+	Content []DGraphContent
+	// Newer and Older link to the neighbouring pages of a paged listing.
+	Newer string
+	Older string
+}
+
+// listingPageSize is how many cards a writer or label page shows.
+const listingPageSize = 30
+
+type PrintStart struct {
+	Trending []DGraphContent
+	Content  []DGraphContent
 }
 
 type PrintSpotify struct {
@@ -164,7 +219,13 @@ type PrintSpotify struct {
 	Id      string
 	OldId   string
 	Image   string
-	Options []SpotifyOption
+	Current string
+	State   string
+	// Connected is whether a user is connected for playlist changes.
+	Connected bool
+	Counts    []StateCount
+	Filter    SearchFilter
+	Options   []SpotifyOption
 }
 
 func clearMarkers(input string) string {
@@ -228,8 +289,47 @@ func artistNames(list []DGraphArtist) string {
 
 	return strings.Join(names, " & ")
 }
-func toUrl(name string) string {
-	return regexp.MustCompile(`[^a-zA-Z0-9]+`).ReplaceAllString(name, "")
+
+func (app *application) header(title, path string) HeaderData {
+	h := HeaderData{Title: title}
+	if path != "" {
+		h.Canonical = app.baseURL + path
+		if p := oembedPath(h.Canonical, "json"); p != "" {
+			h.OEmbedJson = app.baseURL + p
+			h.OEmbedXml = app.baseURL + oembedPath(h.Canonical, "xml")
+		}
+	}
+	return h
+}
+
+func (app *application) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"escapeText":   escapeText,
+		"clearMarkers": clearMarkers,
+		"artistsNames": artistNames,
+		"toUrl":        toUrl,
+		"typeText":     typeText,
+		"contentPath":  contentPath,
+		"artistPath":   artistPath,
+		"header":       app.header,
+	}
+}
+
+func (app *application) parseTemplates() (*template.Template, error) {
+	return template.New("rootsy").Funcs(app.templateFuncs()).ParseGlob(app.TemplatePath + "/*.tmpl")
+}
+
+var uidPattern = regexp.MustCompile(`^0x[0-9a-f]+$`)
+
+func validUid(uid string) bool {
+	return uidPattern.MatchString(uid)
+}
+
+// uuidPattern matches what crypto.randomUUID() gives in the browser.
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+func validUuid(uuid string) bool {
+	return uuidPattern.MatchString(uuid)
 }
 
 func typeText(name string) string {
@@ -247,74 +347,60 @@ func typeText(name string) string {
 	}
 }
 
-func (app *application) printStart(wr io.Writer, ctx context.Context) {
+// Pools the start page and the "load more" list sample from.
+const (
+	extraPool = `{
+		candidates(func:has(read_count), orderasc:read_count, orderasc:view_count, first: 200) @filter(type(Content)) {` + cardFields + `
+		}
+	}`
+	rootsyPool = `{
+		var(func:eq(name, "rootsy")) {
+			c as ~label
+		}
+		candidates(func: uid(c), orderasc:read_count, first: 50) {` + cardFields + `
+		}
+	}`
+)
 
+func (app *application) pool(ctx context.Context, name, q string) []DGraphContent {
 	dc := api.NewDgraphClient(app.conn)
 	dg := dgo.NewDgraphClient(dc)
 
-	q := `query Content {
-	rootsy(func:eq(name, "rootsy")){
-	  uid
-	  name
-	  content:~label ( orderasc:read_count, orderasc:random, first: 5){
-		  name
-			  lead_in_text
-			  type
-			  uid
-			  pic
-			  published_at
-			  artist {
-				  name
-			  }
-			  written_by {
-				  name
-			  }
-	}
-	}
-			  extra(func:has(read_count), orderasc:read_count, orderasc:random, first: 15) @filter(type(Content)) {
-			  name
-			  lead_in_text
-			  type
-			  uid
-			  pic
-			  published_at
-			  artist {
-				  name
-			  }
-			  written_by {
-				  name
-			  }
-			}
-		}`
-
-	txn := dg.NewTxn()
-	defer txn.Discard(ctx)
-
-	res, err := txn.Query(ctx, q)
+	content, err := app.pools.get(name, func() ([]DGraphContent, error) {
+		return loadPool(ctx, dg, q)
+	})
 	if err != nil {
-
-		panic(err.Error())
+		panic(err)
 	}
 
-	var resp ContentResponse
+	return content
+}
 
-	//fmt.Println(string(res.Json))
-	err = json.Unmarshal(res.Json, &resp)
+func (app *application) printStart(wr io.Writer, ctx context.Context) {
 
-	if err != nil {
-		panic(err)
-	}
+	extra := app.pool(ctx, "start/extra", extraPool)
+	rootsy := app.pool(ctx, "start/rootsy", rootsyPool)
 
+	nExtra, nTotal := startMix(ctx)
 	startContent := []DGraphContent{}
-	pickContent("", &startContent, resp.Extra, 16)
-	pickContent("", &startContent, resp.Rootsy[0].Content, 24)
-	updateRandom(startContent, dg, ctx)
+	pickContent("", &startContent, withReason(sampleContent(extra, nExtra, app.viewWeight), sourceStart), nExtra)
+	pickContent("", &startContent, withReason(sampleContent(rootsy, nTotal-nExtra, app.viewWeight), sourceRootsy), nTotal)
 
 	rand.Shuffle(len(startContent), func(i, j int) {
 		startContent[i], startContent[j] = startContent[j], startContent[i]
 	})
+	app.countViews(ctx, startContent)
+
+	start := PrintStart{Content: startContent}
+	if app.startTrending > 0 {
+		trending, err := app.trending(ctx, 7, app.startTrending)
+		if err != nil {
+			fmt.Println(err)
+		}
+		start.Trending = trending
+	}
 
-	app.executeTemplate(wr, "start", startContent)
+	app.executeTemplate(wr, "start", start)
 }
 
 func (app *application) printSearch(search string, wr io.Writer, ctx context.Context) {
@@ -369,86 +455,29 @@ func (app *application) executeTemplate(wr io.Writer, name string, content any)
 }
 
 func (app *application) apiExtraContent(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-
-	dc := api.NewDgraphClient(app.conn)
-	dg := dgo.NewDgraphClient(dc)
-
-	q := `query Content {
-		extra(func:has(read_count), orderasc:read_count,orderasc:view_count, orderasc:random, first: 15) @filter(type(Content)) {
-			name
-			lead_in_text
-			type
-			uid
-			pic
-			published_at
-			artist {
-				name
-			}
-			written_by {
-				name
-			}
-	  	}
-	  }`
-
-	txn := dg.NewTxn()
-	defer txn.Discard(ctx)
-
-	res, err := txn.Query(ctx, q)
-	if err != nil {
-
-		panic(err.Error())
-	}
-
-	var resp ContentResponse
-
-	//fmt.Println(string(res.Json))
-	err = json.Unmarshal(res.Json, &resp)
+	extra := withReason(sampleContent(app.pool(r.Context(), "start/extra", extraPool), 15, app.viewWeight), sourceExtra)
+	app.countViews(r.Context(), extra)
 
-	if err != nil {
-		panic(err)
-	}
-
-	updateRandom(resp.Extra, dg, ctx)
 	w.Header().Set("Content-Type", "application/json")
 	list := []ExtraContent{}
-	for _, c := range resp.Extra {
-		list = append(list, ExtraContent{
-			Name:       c.Name,
-			Uid:        c.Uid,
-			Url:        fmt.Sprintf("/content/%s/%s", c.Uid, toUrl(c.Name)),
-			LeadInText: string(clearMarkers(c.LeadInText)),
-			Pic:        c.Pic,
-			Type:       c.Type,
-			TypeText:   typeText(c.Type),
-			WrittenBy:  c.WrittenBy[0].Name,
-		})
+	for _, c := range extra {
+		list = append(list, extraContent(c))
 	}
 
 	pb, err := json.Marshal(list)
+	if err != nil {
+		panic(err)
+	}
 	w.Write(pb)
 }
 
-func (app *application) printContent(uid string, wr io.Writer, ctx context.Context) {
+func (app *application) printContent(uid, slug string, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 
 	dc := api.NewDgraphClient(app.conn)
 	dg := dgo.NewDgraphClient(dc)
 
 	q := `query Content($terms: string) {
-		extra(func:has(read_count), orderasc:read_count, orderasc:random, first: 15) @filter(type(Content)) {
-			name
-			lead_in_text
-			type
-			uid
-			pic
-			published_at
-			artist {
-				name
-			}
-			written_by {
-				name
-			}
-	  	}
 		content(func: uid($terms)) {
 			uid
 		   	name
@@ -462,54 +491,9 @@ func (app *application) printContent(uid string, wr io.Writer, ctx context.Conte
 				uid
 				pic
 				num_content: count(~artist)
-				content: ~artist  (first:10, orderasc:read_count, orderasc:random){
-					name
-					lead_in_text
-					type
-					uid
-					pic
-					published_at
-					artist {
-						name
-					}
-					written_by {
-						name
-					}
-				}
 			}
 			written_by {
 				name
-				content: ~written_by (first:10, orderasc:read_count, orderasc:random){
-					name
-					lead_in_text
-					type
-					uid
-					pic
-					published_at
-					artist {
-						name
-					}
-					written_by {
-						name
-					}
-				 }
-			}
-			label {
-				name
-				content: ~label (first:10, orderasc:read_count,  orderasc:random){
-					name
-					lead_in_text
-					type
-					uid
-					pic
-					published_at
-					artist {
-						name
-					}
-					written_by {
-						name
-					}
-				}
 			}
 		}
 	  }`
@@ -531,56 +515,39 @@ func (app *application) printContent(uid string, wr io.Writer, ctx context.Conte
 		panic(err)
 	}
 
-	c := resp.Content[0]
-	for _, l := range c.Label {
-		pickContent(c.Uid, &c.Content, l.Content, 6)
-		for _, c2 := range l.Content {
-
-			fmt.Println(c2.Name)
-		}
-	}
-
-	for _, l := range c.Artist {
-		pickContent(c.Uid, &c.Content, l.Content, 10)
-		for _, c2 := range l.Content {
-
-			fmt.Println(c2.Name)
-		}
-
+	if len(resp.Content) != 1 {
+		http.NotFound(w, r)
+		return
 	}
-	for _, l := range c.WrittenBy {
-		for _, c2 := range l.Content {
 
-			fmt.Println(c2.Name)
-		}
-		pickContent(c.Uid, &c.Content, l.Content, 14)
+	c := resp.Content[0]
+	if slug != toUrl(c.Name) {
+		http.Redirect(w, r, contentPath(c.Uid, c.Name), http.StatusMovedPermanently)
+		return
 	}
 
-	for _, c2 := range resp.Extra {
-		fmt.Println(c2.Name)
+	for _, rec := range app.recommenderFor(ctx).Recommend(ctx, dg, c.Uid) {
+		rec.Content.Reason = rec.Reason
+		c.Content = append(c.Content, rec.Content)
 	}
 
-	pickContent(c.Uid, &c.Content, resp.Extra, 16)
-
 	rand.Shuffle(len(c.Content), func(i, j int) {
 		c.Content[i], c.Content[j] = c.Content[j], c.Content[i]
 	})
 
-	updateRandom(c.Content, dg, ctx)
-
-	for _, c2 := range c.Content {
+	app.countViews(ctx, c.Content)
 
-		fmt.Println(c2.Name)
-	}
-
-	if c.Spotify == "x" {
+	if c.Spotify == spotifyLegacyPending {
 		c.Spotify = ""
 	}
 
-	app.executeTemplate(wr, "content", c)
+	c.ReadToken = app.readTokens.issue(c.Uid)
+
+	app.executeTemplate(w, "content", c)
 }
 
-func (app *application) printArtist(uid string, wr io.Writer, ctx context.Context) {
+func (app *application) printArtist(uid, slug string, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 
 	dc := api.NewDgraphClient(app.conn)
 	dg := dgo.NewDgraphClient(dc)
@@ -630,8 +597,115 @@ func (app *application) printArtist(uid string, wr io.Writer, ctx context.Contex
 		panic(err)
 	}
 
-	app.executeTemplate(wr, "artist", resp.Artist[0])
+	if len(resp.Artist) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	a := resp.Artist[0]
+	if slug != toUrl(a.Name) {
+		http.Redirect(w, r, artistPath(a.Uid, a.Name), http.StatusMovedPermanently)
+		return
+	}
+
+	app.executeTemplate(w, "artist", a)
+}
+
+// printListing shows everything reachable from uid through the reverse
+// edge, used for the writer and label pages.
+func (app *application) printListing(edge string, path func(uid, name string) string, uid, slug string, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	dc := api.NewDgraphClient(app.conn)
+	dg := dgo.NewDgraphClient(dc)
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	q := `query Listing($terms: string, $first: int, $offset: int) {
+		listing(func: uid($terms)) @filter(has(` + edge + `)) {
+			uid
+			name
+			total: count(` + edge + `)
+			content: ` + edge + ` (orderdesc: published_at, first: $first, offset: $offset) {
+				name
+				lead_in_text
+				type
+				uid
+				pic
+				published_at
+				artist {
+					name
+				}
+				written_by {
+					name
+				}
+			}
+		}
+	  }`
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	res, err := txn.QueryWithVars(ctx, q, map[string]string{
+		"$terms":  uid,
+		"$first":  strconv.Itoa(listingPageSize),
+		"$offset": strconv.Itoa((page - 1) * listingPageSize),
+	})
+	if err != nil {
+
+		panic(err.Error())
+	}
+
+	var resp ListingResponse
+
+	err = json.Unmarshal(res.Json, &resp)
+
+	if err != nil {
+		panic(err)
+	}
+
+	if len(resp.Listing) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	l := resp.Listing[0]
+	if slug != toUrl(l.Name) {
+		http.Redirect(w, r, path(l.Uid, l.Name), http.StatusMovedPermanently)
+		return
+	}
+
+	if page > 1 && len(l.Content) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	p := PrintListing{
+		Name:    l.Name,
+		Path:    path(l.Uid, l.Name),
+		Content: l.Content,
+	}
+	if page == 2 {
+		p.Newer = p.Path
+	} else if page > 2 {
+		p.Newer = fmt.Sprintf("%s?page=%d", p.Path, page-1)
+	}
+	if page*listingPageSize < l.Total {
+		p.Older = fmt.Sprintf("%s?page=%d", p.Path, page+1)
+	}
+
+	app.executeTemplate(w, "listing", p)
+}
 
+// withReason marks which source the cards came from, for click tracking.
+func withReason(content []DGraphContent, reason string) []DGraphContent {
+	for i := range content {
+		content[i].Reason = reason
+	}
+	return content
 }
 
 func hasContent(haystack *[]DGraphContent, needle string) bool {
@@ -660,13 +734,26 @@ func pickContent(current string, existing *[]DGraphContent, candidates []DGraphC
 
 func (app *application) handler(w http.ResponseWriter, r *http.Request) {
 
+	if _, ok := app.redirects.lookup(r); ok || isLegacy(r) {
+		app.legacy(w, r)
+		return
+	}
+
 	parts := strings.SplitN(r.URL.Path, "/", 4)
 	if len(parts) >= 3 {
+		slug := ""
+		if len(parts) == 4 {
+			slug = parts[3]
+		}
 		switch parts[1] {
 		case "artist":
-			app.printArtist(parts[2], w, r.Context())
+			app.printArtist(parts[2], slug, w, r)
 		case "content":
-			app.printContent(parts[2], w, r.Context())
+			app.printContent(parts[2], slug, w, r)
+		case "writer":
+			app.printListing("~written_by", writerPath, parts[2], slug, w, r)
+		case "label":
+			app.printListing("~label", labelPath, parts[2], slug, w, r)
 		case "search":
 			app.printSearch(strings.Join(r.URL.Query()["terms"], " "), w, r.Context())
 		default:
@@ -692,11 +779,37 @@ func (app *application) handler(w http.ResponseWriter, r *http.Request) {
 
 func (app *application) readCounter(w http.ResponseWriter, r *http.Request) {
 	parts := strings.SplitN(r.URL.Path, "/", 5)
-	if len(parts) < 4 {
+	if len(parts) < 4 || !validUid(parts[2]) || !validUuid(parts[3]) {
+		http.Error(w, "Bad read", http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("Read: %s\n", parts[2])
+
+	if isBot(r.Context()) {
+		app.bots.count("reads")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err := app.readTokens.verify(r.URL.Query().Get("t"), parts[2], parts[3])
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	viewer := ""
+	if !doNotTrack(r) {
+		viewer = app.viewerSalt.hash(parts[3])
+	}
+	variant := app.experiment.label(app.experiment.assign(parts[3]))
+	err = app.updateCounter(parts[2], viewer, variant, r.Context())
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Could not count read", http.StatusInternalServerError)
 		return
 	}
-	fmt.Printf("Read: %s", parts[2])
-	app.updateCounter(parts[2], parts[3], r.Context())
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (app *application) sse(w http.ResponseWriter, r *http.Request) {
@@ -736,8 +849,7 @@ func (app *application) sse(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			if ev.Has(fsnotify.Write) {
-				tmp, err := template.New("rootsy").Funcs(template.FuncMap{"escapeText": escapeText, "clearMarkers": clearMarkers, "artistsNames": artistNames, "toUrl": toUrl, "typeText": typeText}).ParseGlob(app.TemplatePath + "/*.tmpl")
-				//t, err := template.ParseGlob("templates/*.tmpl")
+				tmp, err := app.parseTemplates()
 
 				if err != nil {
 					fmt.Println(err)
@@ -766,181 +878,152 @@ func (app *application) sse(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func updateRandom(content []DGraphContent, dg *dgo.Dgraph, ctx context.Context) {
-	update := []Random{}
-
-	for _, c := range content {
-		r := Random{}
-		r.Uid = c.Uid
-		r.Random = rand.Intn(1000)
-		r.ViewCount = c.ViewCount + 1
-		update = append(update, r)
-	}
-
-	pb, err := json.Marshal(update)
-	// Check error
-	if err != nil {
-		panic(err.Error())
-	}
-
-	txn := dg.NewTxn()
-	defer txn.Discard(ctx)
-
-	mu := &api.Mutation{
-		SetJson:   pb,
-		CommitNow: true,
-	}
-
-	_, err = txn.Mutate(ctx, mu)
-	if err != nil {
-		fmt.Println(err)
-	}
-}
-
-func (app *application) updateCounter(uid, uuid string, ctx context.Context) {
+// updateCounter increments read_count and records the read on the Viewer
+// node of viewer in one upsert, so concurrent reads cannot lose increments.
+// The read is tagged with the experiment variant, if any. With an empty
+// viewer only read_count is updated. The caller must have validated uid.
+func (app *application) updateCounter(uid, viewer, variant string, ctx context.Context) error {
 
 	dc := api.NewDgraphClient(app.conn)
 	dg := dgo.NewDgraphClient(dc)
 
-	q := `query CounterQuery($terms: string) {
-		counter (func: uid($terms)) @filter(type(Content)) {
-			uid
-			name
-		  	read_count
+	q := `query Counter($uid: string, $uuid: string) {
+		c as var(func: uid($uid)) @filter(type(Content) AND has(read_count)) {
+			rc as read_count
+			n as math(rc + 1)
 		}
-	  }`
-
-	txn := dg.NewTxn()
-	defer txn.Discard(ctx)
-
-	res, err := txn.QueryWithVars(ctx, q, map[string]string{"$terms": uid})
-	if err != nil {
-
-		panic(err.Error())
-	}
-
-	var resp CounterResponse
-
-	//fmt.Println(string(res.Json))
-	err = json.Unmarshal(res.Json, &resp)
-
-	if err != nil {
-		panic(err)
-	}
-
-	fmt.Println(resp)
-	if len(resp.Counter) != 1 {
-		return
-	}
-
-	item := resp.Counter[0]
-
-	item.ReadCount++
-
-	pb, err := json.Marshal(item)
-	// Check error
-	if err != nil {
-		panic(err.Error())
-	}
-
-	mu := &api.Mutation{
-		SetJson:   pb,
-		CommitNow: true,
-	}
-
-	_, err = txn.Mutate(ctx, mu)
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	txn = dg.NewTxn()
-	defer txn.Discard(ctx)
-	ts := time.Now().Format(time.RFC3339)
-
-	fmt.Println(ts)
+		z as var(func: uid($uid)) @filter(type(Content) AND NOT has(read_count))
+		t as var(func: uid($uid)) @filter(type(Content))
+		v as var(func: eq(uuid, $uuid)) @filter(type(Viewer))
+	}`
 
-	q = `query Viewer($terms: string){
-		Q(func:eq(uuid, $terms)) {
-			v as uid
+	mutations := []*api.Mutation{
+		{
+			Cond:      `@if(eq(len(c), 1))`,
+			SetNquads: []byte(`uid(c) <read_count> val(n) .`),
+		},
+		{
+			Cond:      `@if(eq(len(z), 1))`,
+			SetNquads: []byte(`uid(z) <read_count> "1"^^<xs:int> .`),
+		},
+	}
+
+	if viewer != "" {
+		pb, err := json.Marshal(ViewerRead{
+			Uid:   "uid(v)",
+			Uuid:  viewer,
+			DType: "Viewer",
+			Content: ViewerContent{
+				Uid:     "uid(t)",
+				Time:    time.Now().Format(time.RFC3339),
+				Variant: variant,
+			},
+		})
+		if err != nil {
+			return err
 		}
-	}`
-	mu = &api.Mutation{
-		SetNquads: []byte(`uid(v) <uuid> "` + uuid + `" .
-		uid(v) <dgraph.type> "Viewer" .
-		uid(v) <content> <` + uid + `> (time=` + ts + `) .`),
+		mutations = append(mutations, &api.Mutation{
+			Cond:    `@if(eq(len(t), 1))`,
+			SetJson: pb,
+		})
 	}
 
-	fmt.Println(`viewer <uuid> "` + uuid + `" .
-	viewer <dgraph.type> "Viewer" .
-	viewer <content> "` + uid + `" (time=` + ts + `) .`)
 	req := &api.Request{
 		Query:     q,
-		Mutations: []*api.Mutation{mu},
-		Vars:      map[string]string{"$terms": uuid},
+		Vars:      map[string]string{"$uid": uid, "$uuid": viewer},
+		Mutations: mutations,
 		CommitNow: true,
 	}
-	_, err = txn.Do(ctx, req)
-	if err != nil {
-		fmt.Println(err)
-	}
-}
-
-func UpdateSpotifyUrl(uid, url string, dg *dgo.Dgraph, ctx context.Context) {
-	update := UpdateSpotify{
-		Uid:     uid,
-		Spotify: url,
-	}
-	pb, err := json.Marshal(update)
-	// Check error
-	if err != nil {
-		panic(err.Error())
-	}
 
 	txn := dg.NewTxn()
 	defer txn.Discard(ctx)
 
-	mu := &api.Mutation{
-		SetJson:   pb,
-		CommitNow: true,
-	}
-
-	_, err = txn.Mutate(ctx, mu)
-	if err != nil {
-		fmt.Println(err)
-	}
+	_, err := txn.Do(ctx, req)
+	return err
 }
 
-func saveSpotify(oldid, url string) {
+// saveSpotify appends each decision to spotify.tab as a backup:
+// oldid, url and state separated by tabs.
+func saveSpotify(oldid, url, state string) {
 	f, err := os.OpenFile("spotify.tab",
 		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Println(err)
 	}
 	defer f.Close()
-	if _, err := f.WriteString(fmt.Sprintf("%s\t%s\n", oldid, url)); err != nil {
+	if _, err := f.WriteString(fmt.Sprintf("%s\t%s\t%s\n", oldid, url, state)); err != nil {
 		log.Println(err)
 	}
 }
 
+// spotify is the manual queue. It shows one album in the selected state
+// with scored Spotify candidates, and takes link, no link, skip and undo
+// decisions.
 func (app *application) spotify(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	dc := api.NewDgraphClient(app.conn)
 	dg := dgo.NewDgraphClient(dc)
 
-	id := r.PostFormValue("id")
+	state := r.FormValue("state")
+	if !validSpotifyState(state) {
+		state = spotifyPending
+	}
+	user, _, _ := r.BasicAuth()
+
+	filter := SearchFilter{
+		Market:       strings.ToUpper(strings.TrimSpace(r.FormValue("market"))),
+		Singles:      r.FormValue("singles") != "",
+		Compilations: r.FormValue("compilations") != "",
+	}
+	if filter.Market == "" {
+		filter.Market = app.spotifyMarket
+	}
+
+	if r.Method == http.MethodPost {
+		id := r.PostFormValue("id")
+		oldid := r.PostFormValue("oldid")
+		url := r.PostFormValue("url")
+
+		var err error
+		switch r.PostFormValue("action") {
+		case "undo":
+			_, err = undoSpotify(ctx, dg, user)
+		case "skip":
+			err = setSpotifyState(ctx, dg, id, spotifySkipped, "", user)
+			if err == nil {
+				saveSpotify(oldid, "", spotifySkipped)
+			}
+		default:
+			decision := spotifyLinked
+			if url == "" {
+				decision = spotifyNoMatch
+			}
+			err = setSpotifyState(ctx, dg, id, decision, url, user)
+			if err == nil {
+				saveSpotify(oldid, url, decision)
+			}
+		}
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Could not save the decision", http.StatusBadRequest)
+			return
+		}
 
-	if id != "" {
-		saveSpotify(r.PostFormValue("oldid"), r.PostFormValue("url"))
-		UpdateSpotifyUrl(id, r.PostFormValue("url"), dg, ctx)
+		http.Redirect(w, r, "/spotify?"+filter.query(state), http.StatusSeeOther)
+		return
 	}
 
-	q := `query SpotifyQuery {
-		content (func: eq(spotify, "x"), first: 1) @filter(type(Content) AND NOT eq(type, "article")) {
+	vars, fn := spotifyStateVar("s", state)
+	q := `{
+		` + vars + `
+		content (func: ` + fn + `, first: 1) @filter(type(Content) AND NOT eq(type, "article")) {
 			uid
 			oldId
 			pic
+			spotify
 			name: album
+			published_at
       		artist {
         		name
       		}
@@ -957,36 +1040,42 @@ func (app *application) spotify(w http.ResponseWriter, r *http.Request) {
 
 	var resp ContentResponse
 
-	//fmt.Println(string(res.Json))
 	err = json.Unmarshal(res.Json, &resp)
 
 	if err != nil {
 		panic(err)
 	}
 
-	fmt.Println(resp)
-	if len(resp.Content) != 1 {
-		return
+	counts, err := spotifyCounts(ctx, dg, state)
+	if err != nil {
+		fmt.Println(err)
 	}
-
-	artistName := "No artist"
-	if len(resp.Content) > 0 && len(resp.Content[0].Artist) > 0 {
-		artistName = resp.Content[0].Artist[0].Name
+	for i := range counts {
+		counts[i].Href = "/spotify?" + filter.query(counts[i].State)
 	}
-	album := resp.Content[0].Name
 
-	opts, err := app.sp.Search(strings.TrimSuffix(strings.TrimSuffix(artistName, ", The"), ", the"), album)
+	item := PrintSpotify{State: state, Counts: counts, Filter: filter, Connected: app.spUser.Connected()}
+	if len(resp.Content) == 1 {
+		c := resp.Content[0]
 
-	if err != nil {
-		fmt.Printf("Error searching Spotify: %v", err)
-	}
-	item := PrintSpotify{
-		Name:    album,
-		Artist:  artistName,
-		Id:      resp.Content[0].Uid,
-		OldId:   resp.Content[0].Id,
-		Image:   resp.Content[0].Pic,
-		Options: opts,
+		artistName := "No artist"
+		if len(c.Artist) > 0 {
+			artistName = c.Artist[0].Name
+		}
+		subject := subjectOf(c)
+
+		opts, err := app.sp.Search(subject.Artist, subject.Album, filter)
+		if err != nil {
+			fmt.Printf("Error searching Spotify: %v", err)
+		}
+
+		item.Name = c.Name
+		item.Artist = artistName
+		item.Id = c.Uid
+		item.OldId = c.Id
+		item.Image = c.Pic
+		item.Current = c.Spotify
+		item.Options = scoreOptions(subject, opts)
 	}
 
 	app.executeTemplate(w, "spotify", item)
@@ -1033,63 +1122,6 @@ func (app *application) stats(w http.ResponseWriter, r *http.Request) {
 	app.executeTemplate(w, "stats", resp.Stats)
 }
 
-func (app *application) handleOldContent(prefix, cat string, w http.ResponseWriter, r *http.Request) {
-
-	id := r.URL.Query()["id"]
-
-	if len(id) != 1 {
-		return
-	}
-
-	ctx := r.Context()
-
-	dc := api.NewDgraphClient(app.conn)
-	dg := dgo.NewDgraphClient(dc)
-
-	q := `query OldContent($terms: string) {
-		content (func: eq(oldId, $terms)) {
-			uid
-			name
-		}
-	  }`
-
-	txn := dg.NewTxn()
-	defer txn.Discard(ctx)
-
-	res, err := txn.QueryWithVars(ctx, q, map[string]string{"$terms": fmt.Sprintf("%s-%s", prefix, id[0])})
-	if err != nil {
-
-		panic(err.Error())
-	}
-
-	var resp DGraphContent
-
-	//fmt.Println(string(res.Json))
-	err = json.Unmarshal(res.Json, &resp)
-
-	if err != nil {
-		panic(err)
-	}
-
-	fmt.Println(resp)
-	if len(resp.Content) != 1 {
-		return
-	}
-
-	http.Redirect(w, r, fmt.Sprintf("https://www.rootsy.nu/%s/%s/%s", cat, resp.Content[0].Uid, toUrl(resp.Content[0].Name)), 301)
-}
-
-func (app *application) handleOldReview(w http.ResponseWriter, r *http.Request) {
-	app.handleOldContent("r", "content", w, r)
-}
-
-func (app *application) handleOldArticle(w http.ResponseWriter, r *http.Request) {
-	app.handleOldContent("f", "content", w, r)
-}
-func (app *application) handleOldArtist(w http.ResponseWriter, r *http.Request) {
-	app.handleOldContent("a", "artist", w, r)
-}
-
 func (app *application) basicAuth(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		username, password, ok := r.BasicAuth()
@@ -1137,6 +1169,16 @@ func main() {
 		log.Fatal("DGraph URL must be provided")
 	}
 
+	app.baseURL = strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
+	if app.baseURL == "" {
+		app.baseURL = "https://www.rootsy.nu"
+	}
+
+	legacyLog := os.Getenv("LEGACY_LOG")
+	if legacyLog == "" {
+		legacyLog = "legacy.tab"
+	}
+
 	app.StaticPath = root_path + "static"
 	app.TemplatePath = root_path + "templates"
 
@@ -1155,25 +1197,88 @@ func main() {
 	}
 
 	var err error
-	app.sp, err = NewSpotify(app.spotify_cred.key, app.spotify_cred.secret)
+	spotifyOpts := []SpotifyOpt{}
+	if u := os.Getenv("SPOTIFY_ACCOUNTS_URL"); u != "" {
+		spotifyOpts = append(spotifyOpts, WithAccountsURL(u))
+	}
+	if u := os.Getenv("SPOTIFY_API_URL"); u != "" {
+		spotifyOpts = append(spotifyOpts, WithAPIURL(u))
+	}
+	app.sp, err = NewSpotify(app.spotify_cred.key, app.spotify_cred.secret, spotifyOpts...)
+	if err != nil {
+		log.Fatalln("Error setting up spotify:", err)
+	}
+
+	tokenFile := os.Getenv("SPOTIFY_TOKEN_FILE")
+	if tokenFile == "" {
+		tokenFile = "spotify-token.json"
+	}
+	app.spUser, err = NewSpotify(app.spotify_cred.key, app.spotify_cred.secret, append(spotifyOpts, WithUserToken(tokenFile))...)
 	if err != nil {
 		log.Fatalln("Error setting up spotify:", err)
 	}
+	app.connects = newSpotifyConnects()
+
+	app.spotifyMarket = os.Getenv("SPOTIFY_MARKET")
+	if app.spotifyMarket == "" {
+		app.spotifyMarket = "SE"
+	}
 
 	if err != nil {
 		panic(err)
 	}
 
-	if len(os.Args) == 2 && os.Args[1] == "spotify" {
-		err = app.sp.ClearPlaylist("39kgihD6NPmYjAKM8wKCoM")
-		if err != nil {
-			panic(err)
-		}
-		err = app.sp.AddAlbumToPlaylist("39kgihD6NPmYjAKM8wKCoM", "34xaLN7rDecGEK5UGIVbeJ")
-		if err != nil {
-			panic(err)
-		}
-		return
+	weights := os.Getenv("RECOMMEND_WEIGHTS")
+	if weights == "" {
+		weights = defaultWeights
+	}
+	app.startTrending = envInt("START_TRENDING", 0)
+	app.views = newViewCounter()
+	clicksPath := os.Getenv("CLICK_STATS")
+	if clicksPath == "" {
+		clicksPath = "clicks.json"
+	}
+	app.clicks, err = loadClickStats(clicksPath)
+	if err != nil {
+		log.Fatalln("Error loading click stats:", err)
+	}
+	app.legacyMisses, err = loadLegacyMisses(legacyLog)
+	if err != nil {
+		log.Fatalln("Error loading legacy log:", err)
+	}
+	app.reports = newTTLCache[AnalyticsReport](envDuration("ANALYTICS_TTL", 15*time.Minute))
+	app.journeys = newTTLCache[JourneyReport](envDuration("ANALYTICS_TTL", 15*time.Minute))
+	proxies, err := parseProxies(os.Getenv("TRUST_PROXY"))
+	if err != nil {
+		log.Fatalln("TRUST_PROXY:", err)
+	}
+	app.bots = newBotFilter(envInt("BOT_RATE_LIMIT", 120), time.Minute, proxies)
+	app.readTokens = newReadTokens(os.Getenv("READ_TOKEN_SECRET"), envDuration("READ_MIN_DWELL", 25*time.Second))
+	app.pools = newPoolCache(envDuration("POOL_TTL", 10*time.Minute))
+	app.thumbs = newTTLCache[image.Config](24 * time.Hour)
+	app.recommender, err = NewRecommendEngine(weights, 16, app.pools, app.viewWeight)
+	if err != nil {
+		log.Fatalln("Error setting up recommendations:", err)
+	}
+
+	saltPath := os.Getenv("VIEWER_SALT_FILE")
+	if saltPath == "" {
+		saltPath = "viewer-salt.json"
+	}
+	app.viewerSalt, err = loadViewerSalt(saltPath, envDuration("VIEWER_SALT_ROTATION", 24*time.Hour))
+	if err != nil {
+		log.Fatalln("Error loading viewer salt:", err)
+	}
+	app.viewerRetention = envInt("VIEWER_RETENTION_DAYS", 180)
+
+	app.experiment, err = loadExperiment(os.Getenv("EXPERIMENT_FILE"), app.pools, app.viewWeight)
+	if err != nil {
+		log.Fatalln("Error loading experiment:", err)
+	}
+
+	app.redirects, err = loadRedirectMap(os.Getenv("REDIRECT_MAP"))
+	if err != nil {
+		log.Fatalln("Error loading redirect map:", err)
 	}
 
 	app.conn, err = grpc.Dial(dgraph, grpc.WithTransportCredentials(insecure.NewCredentials()))
@@ -1182,13 +1287,79 @@ func main() {
 		log.Fatal("While trying to dial gRPC")
 	}
 
-	app.templates, err = template.New("rootsy").Funcs(template.FuncMap{"escapeText": escapeText, "clearMarkers": clearMarkers, "artistsNames": artistNames, "toUrl": toUrl, "typeText": typeText}).ParseGlob(app.TemplatePath + "/*.tmpl")
-	//t, err := template.ParseGlob("templates/*.tmpl")
+	app.templates, err = app.parseTemplates()
 
 	if err != nil {
 		panic(err)
 	}
 
+	if len(os.Args) >= 2 {
+		switch os.Args[1] {
+		case "coread":
+			err = app.computeCoread(context.Background())
+			if err != nil {
+				log.Fatalln("Error computing co-reads:", err)
+			}
+			return
+		case "similarity":
+			err = app.computeSimilarity(context.Background())
+			if err != nil {
+				log.Fatalln("Error computing similarity:", err)
+			}
+			return
+		case "spotify-migrate":
+			err = app.migrateSpotify(context.Background())
+			if err != nil {
+				log.Fatalln("Error migrating Spotify links:", err)
+			}
+			return
+		case "spotify-replay":
+			path := "spotify.tab"
+			if len(os.Args) >= 3 {
+				path = os.Args[2]
+			}
+			err = app.replaySpotify(context.Background(), path)
+			if err != nil {
+				log.Fatalln("Error replaying Spotify links:", err)
+			}
+			return
+		case "spotify-match":
+			err = app.matchSpotify(context.Background())
+			if err != nil {
+				log.Fatalln("Error matching Spotify:", err)
+			}
+			return
+		case "playlist":
+			if len(os.Args) != 5 || os.Args[2] != "sync" {
+				log.Fatalln("Usage: playlist sync <playlist id> <selection>")
+			}
+			err = app.syncPlaylist(context.Background(), os.Args[3], os.Args[4])
+			if err != nil {
+				log.Fatalln("Error syncing playlist:", err)
+			}
+			return
+		case "hash-viewers":
+			err = app.hashViewers(context.Background())
+			if err != nil {
+				log.Fatalln("Error hashing viewers:", err)
+			}
+			return
+		case "purge-viewers":
+			err = app.purgeViewers(context.Background())
+			if err != nil {
+				log.Fatalln("Error purging viewers:", err)
+			}
+			return
+		}
+	}
+
+	app.scheduleNow("coread", envDuration("COREAD_INTERVAL", 6*time.Hour), app.computeCoread)
+	app.schedule("views", envDuration("VIEW_FLUSH_INTERVAL", time.Minute), app.flushViews)
+	app.schedule("read-tokens", envDuration("READ_TOKEN_PRUNE_INTERVAL", 10*time.Minute), app.pruneReadTokens)
+	app.schedule("purge-viewers", envDuration("VIEWER_PURGE_INTERVAL", 24*time.Hour), app.purgeViewers)
+	app.schedule("clicks", envDuration("CLICK_SAVE_INTERVAL", 5*time.Minute), app.saveClicks)
+	app.schedule("legacy", envDuration("LEGACY_SAVE_INTERVAL", 5*time.Minute), app.saveLegacyMisses)
+
 	if app.debug {
 		http.HandleFunc("/sse", app.sse)
 	}
@@ -1197,16 +1368,62 @@ func main() {
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(app.StaticPath))))
 	http.HandleFunc("/read/", app.readCounter)
 	http.HandleFunc("/spotify", app.basicAuth(app.spotify))
+	http.HandleFunc("/admin/spotify/connect", app.basicAuth(app.spotifyConnect))
+	http.HandleFunc("/admin/spotify/callback", app.basicAuth(app.spotifyCallback))
 	http.HandleFunc("/stats", app.basicAuth(app.stats))
+	http.HandleFunc("/stats/traffic", app.basicAuth(app.trafficStats))
+	http.HandleFunc("/stats/clicks", app.basicAuth(app.clickReport))
+	http.HandleFunc("/stats/experiment", app.basicAuth(app.experimentReport))
+	http.HandleFunc("/analytics", app.basicAuth(app.analytics))
+	http.HandleFunc("/analytics/journeys", app.basicAuth(app.journeyAnalytics))
+	http.HandleFunc("/click", app.click)
 	http.HandleFunc("/api/content/extra", app.apiExtraContent)
-	http.HandleFunc("/recension.php", app.handleOldReview)
-	http.HandleFunc("/artikel.php", app.handleOldArticle)
-	http.HandleFunc("/artist.php", app.handleOldArtist)
+	http.HandleFunc("/api/content/related/", app.apiRelatedContent)
+	http.HandleFunc("/oembed", app.oembed)
+	http.HandleFunc("/popular", app.popular)
+	http.HandleFunc("/trending", app.trendingPage)
 
-	http.HandleFunc("/", app.handler)                            // set router
-	err = http.ListenAndServe(fmt.Sprintf(":%d", app.port), nil) // set listen port
-	if err != nil {
+	http.HandleFunc("/", app.handler) // set router
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", app.port), // set listen port
+		Handler: app.classifyRequests(app.assignVariants(http.DefaultServeMux)),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			log.Println("Shutdown:", err)
+		}
+	}()
+
+	err = srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe: ", err)
 	}
+	<-done
+
+	err = app.flushViews(context.Background())
+	if err != nil {
+		log.Println("Error flushing views:", err)
+	}
 
+	err = app.clicks.save()
+	if err != nil {
+		log.Println("Error saving click stats:", err)
+	}
+
+	err = app.legacyMisses.save()
+	if err != nil {
+		log.Println("Error saving legacy log:", err)
+	}
 }
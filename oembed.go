@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+const (
+	oembedWidth  = 480
+	oembedHeight = 160
+)
+
+// OEmbed is the rich response described in https://oembed.com.
+type OEmbed struct {
+	XMLName         xml.Name `json:"-" xml:"oembed"`
+	Version         string   `json:"version" xml:"version"`
+	Type            string   `json:"type" xml:"type"`
+	Title           string   `json:"title" xml:"title"`
+	AuthorName      string   `json:"author_name,omitempty" xml:"author_name,omitempty"`
+	ProviderName    string   `json:"provider_name" xml:"provider_name"`
+	ProviderUrl     string   `json:"provider_url" xml:"provider_url"`
+	ThumbnailUrl    string   `json:"thumbnail_url,omitempty" xml:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int      `json:"thumbnail_width,omitempty" xml:"thumbnail_width,omitempty"`
+	ThumbnailHeight int      `json:"thumbnail_height,omitempty" xml:"thumbnail_height,omitempty"`
+	Html            string   `json:"html" xml:"html"`
+	Width           int      `json:"width" xml:"width"`
+	Height          int      `json:"height" xml:"height"`
+}
+
+type OEmbedCard struct {
+	Url    string
+	Title  string
+	Author string
+	Pic    string
+	Lead   string
+	Width  int
+	Height int
+}
+
+type OEmbedItem struct {
+	Uid        string              `json:"uid"`
+	Name       string              `json:"name"`
+	Pic        string              `json:"pic"`
+	LeadInText string              `json:"lead_in_text"`
+	Type       string              `json:"type"`
+	WrittenBy  []DGraphContributor `json:"written_by"`
+}
+
+type OEmbedResponse struct {
+	Item []OEmbedItem `json:"item"`
+}
+
+// oembedPath returns the oEmbed endpoint for a page, or an empty string if
+// the page cannot be embedded.
+func oembedPath(canonical, format string) string {
+	u, err := url.Parse(canonical)
+	if err != nil {
+		return ""
+	}
+	if !strings.HasPrefix(u.Path, "/content/") && !strings.HasPrefix(u.Path, "/artist/") {
+		return ""
+	}
+
+	return "/oembed?url=" + url.QueryEscape(canonical) + "&format=" + format
+}
+
+func (app *application) oembed(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "xml" {
+		http.Error(w, "Unsupported format", http.StatusNotImplemented)
+		return
+	}
+
+	target, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || target.Path == "" {
+		http.Error(w, "Bad url", http.StatusBadRequest)
+		return
+	}
+
+	base, _ := url.Parse(app.baseURL)
+	if target.Host != "" && !strings.EqualFold(strings.TrimPrefix(target.Host, "www."), strings.TrimPrefix(base.Host, "www.")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	parts := strings.SplitN(target.Path, "/", 4)
+	if len(parts) < 3 || (parts[1] != "content" && parts[1] != "artist") {
+		http.NotFound(w, r)
+		return
+	}
+
+	dc := api.NewDgraphClient(app.conn)
+	dg := dgo.NewDgraphClient(dc)
+
+	q := `query OEmbed($terms: string) {
+		item(func: uid($terms)) @filter(type(Content) OR type(Artist)) {
+			uid
+			name
+			pic
+			lead_in_text
+			type
+			written_by {
+				name
+			}
+		}
+	  }`
+
+	txn := dg.NewReadOnlyTxn()
+	defer txn.Discard(ctx)
+
+	res, err := txn.QueryWithVars(ctx, q, map[string]string{"$terms": parts[2]})
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+
+	var resp OEmbedResponse
+	err = json.Unmarshal(res.Json, &resp)
+	if err != nil || len(resp.Item) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	item := resp.Item[0]
+
+	// The card is shown on other sites, so the pic needs the host.
+	pic := item.Pic
+	if strings.HasPrefix(pic, "/") {
+		pic = app.baseURL + pic
+	}
+
+	card := OEmbedCard{
+		Title:  item.Name,
+		Pic:    pic,
+		Lead:   clearMarkers(item.LeadInText),
+		Width:  boundedSize(r.URL.Query().Get("maxwidth"), oembedWidth),
+		Height: boundedSize(r.URL.Query().Get("maxheight"), oembedHeight),
+	}
+
+	if parts[1] == "content" {
+		card.Url = app.baseURL + contentPath(item.Uid, item.Name)
+		names := []string{}
+		for _, c := range item.WrittenBy {
+			names = append(names, c.Name)
+		}
+		card.Author = strings.Join(names, " & ")
+	} else {
+		card.Url = app.baseURL + artistPath(item.Uid, item.Name)
+	}
+
+	var html bytes.Buffer
+	app.executeTemplate(&html, "oembed", card)
+
+	embed := OEmbed{
+		Version:      "1.0",
+		Type:         "rich",
+		Title:        item.Name,
+		AuthorName:   card.Author,
+		ProviderName: "Rootsy.nu",
+		ProviderUrl:  app.baseURL + "/",
+		Html:         html.String(),
+		Width:        card.Width,
+		Height:       card.Height,
+	}
+
+	// The spec wants the size with the url, so a pic that can not be
+	// measured is left out.
+	if pic != "" {
+		size, _ := app.thumbs.get(pic, func() (image.Config, error) {
+			size, err := thumbnailSize(pic)
+			if err != nil {
+				// Cached as unknown, so a missing pic is not fetched
+				// for every embed.
+				log.Printf("Measuring thumbnail %s: %v", pic, err)
+				return image.Config{}, nil
+			}
+			return size, nil
+		})
+		if size.Width > 0 && size.Height > 0 {
+			embed.ThumbnailUrl = pic
+			embed.ThumbnailWidth = size.Width
+			embed.ThumbnailHeight = size.Height
+		}
+	}
+
+	if format == "xml" {
+		pb, err := xml.Marshal(embed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		w.Write([]byte(xml.Header))
+		w.Write(pb)
+		return
+	}
+
+	pb, err := json.Marshal(embed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(pb)
+}
+
+// boundedSize returns def, or the requested max size if that is smaller.
+func boundedSize(max string, def int) int {
+	n, err := strconv.Atoi(max)
+	if err != nil || n <= 0 || n > def {
+		return def
+	}
+	return n
+}
+
+var thumbClient = &http.Client{Timeout: 5 * time.Second}
+
+// thumbnailSize reads the size from the header of the image at url,
+// without fetching the whole image.
+func thumbnailSize(url string) (image.Config, error) {
+	res, err := thumbClient.Get(url)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return image.Config{}, fmt.Errorf("%s: %s", url, res.Status)
+	}
+
+	cfg, _, err := image.DecodeConfig(res.Body)
+	return cfg, err
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+const defaultPlaylistLimit = 50
+
+// PlaylistSelection is a named query in the playlist config. Kind is
+// "year" for the most read reviews published that year, "writer" and
+// "label" for the newest reviews of the uid, and "trending" for what is
+// read the last Days days. Tracks is "one" for the first track of each
+// album or "all".
+type PlaylistSelection struct {
+	Kind   string `json:"kind"`
+	Year   int    `json:"year,omitempty"`
+	Uid    string `json:"uid,omitempty"`
+	Days   int    `json:"days,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	Tracks string `json:"tracks,omitempty"`
+}
+
+// loadPlaylistSelections reads the selections from the config file at
+// path, a JSON object keyed by selection name.
+func loadPlaylistSelections(path string) (map[string]PlaylistSelection, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var selections map[string]PlaylistSelection
+	err = json.Unmarshal(b, &selections)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for name, s := range selections {
+		if s.Limit <= 0 {
+			s.Limit = defaultPlaylistLimit
+		}
+		if s.Tracks == "" {
+			s.Tracks = "one"
+		}
+		if s.Tracks != "one" && s.Tracks != "all" {
+			return nil, fmt.Errorf("%s: %s: tracks must be one or all, not %q", path, name, s.Tracks)
+		}
+
+		switch s.Kind {
+		case "year":
+			if s.Year == 0 {
+				return nil, fmt.Errorf("%s: %s: a year selection needs a year", path, name)
+			}
+		case "writer", "label":
+			if !validUid(s.Uid) {
+				return nil, fmt.Errorf("%s: %s: bad uid %q", path, name, s.Uid)
+			}
+		case "trending":
+			if s.Days <= 0 {
+				s.Days = 7
+			}
+		default:
+			return nil, fmt.Errorf("%s: %s: unknown kind %q", path, name, s.Kind)
+		}
+		selections[name] = s
+	}
+
+	return selections, nil
+}
+
+type PlaylistAlbum struct {
+	Uid     string `json:"uid"`
+	Name    string `json:"name"`
+	Spotify string `json:"spotify"`
+}
+
+type PlaylistAlbumResponse struct {
+	Content []PlaylistAlbum `json:"content"`
+	Listing []struct {
+		Content []PlaylistAlbum `json:"content"`
+	} `json:"listing"`
+}
+
+const playlistAlbumFields = `
+				uid
+				name: album
+				spotify`
+
+// selectAlbums returns the linked albums of a selection, in playlist
+// order.
+func (app *application) selectAlbums(ctx context.Context, dg *dgo.Dgraph, s PlaylistSelection) ([]PlaylistAlbum, error) {
+	var q string
+	vars := map[string]string{"$first": fmt.Sprint(s.Limit)}
+	linked := `type(Content) AND NOT eq(type, "article") AND eq(spotify_state, "linked")`
+
+	switch s.Kind {
+	case "year":
+		q = `query Year($first: int, $from: string, $to: string) {
+			content(func: eq(spotify_state, "linked"), orderdesc: read_count, first: $first) @filter(` + linked + ` AND ge(published_at, $from) AND lt(published_at, $to)) {` + playlistAlbumFields + `
+			}
+		}`
+		vars["$from"] = fmt.Sprintf("%d-01-01", s.Year)
+		vars["$to"] = fmt.Sprintf("%d-01-01", s.Year+1)
+	case "writer", "label":
+		edge := "~written_by"
+		if s.Kind == "label" {
+			edge = "~label"
+		}
+		q = `query Listing($uid: string, $first: int) {
+			listing(func: uid($uid)) {
+				content: ` + edge + ` (orderdesc: published_at, first: $first) @filter(` + linked + `) {` + playlistAlbumFields + `
+				}
+			}
+		}`
+		vars["$uid"] = s.Uid
+	case "trending":
+		// Few trending reviews are linked, so rank a wider pool.
+		cards, err := app.trending(ctx, s.Days, 10*s.Limit)
+		if err != nil {
+			return nil, err
+		}
+		return linkedAlbums(ctx, dg, cards, s.Limit)
+	default:
+		return nil, fmt.Errorf("unknown selection kind %q", s.Kind)
+	}
+
+	txn := dg.NewReadOnlyTxn()
+	res, err := txn.QueryWithVars(ctx, q, vars)
+	txn.Discard(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp PlaylistAlbumResponse
+	err = json.Unmarshal(res.Json, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	albums := resp.Content
+	for _, l := range resp.Listing {
+		albums = append(albums, l.Content...)
+	}
+	return albums, nil
+}
+
+// linkedAlbums keeps the linked albums among cards, in the order of
+// cards, up to n of them.
+func linkedAlbums(ctx context.Context, dg *dgo.Dgraph, cards []DGraphContent, n int) ([]PlaylistAlbum, error) {
+	if len(cards) == 0 {
+		return nil, nil
+	}
+
+	uids := []string{}
+	for _, c := range cards {
+		uids = append(uids, c.Uid)
+	}
+
+	q := `{
+		content(func: uid(` + strings.Join(uids, ", ") + `)) @filter(eq(spotify_state, "linked")) {` + playlistAlbumFields + `
+		}
+	}`
+
+	txn := dg.NewReadOnlyTxn()
+	res, err := txn.Query(ctx, q)
+	txn.Discard(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp PlaylistAlbumResponse
+	err = json.Unmarshal(res.Json, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	byUid := map[string]PlaylistAlbum{}
+	for _, a := range resp.Content {
+		byUid[a.Uid] = a
+	}
+
+	albums := []PlaylistAlbum{}
+	for _, c := range cards {
+		if a, ok := byUid[c.Uid]; ok && len(albums) < n {
+			albums = append(albums, a)
+		}
+	}
+	return albums, nil
+}
+
+// spotifyAlbumId returns the id in an open.spotify.com album link.
+func spotifyAlbumId(link string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return "", err
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 || parts[len(parts)-2] != "album" || parts[len(parts)-1] == "" {
+		return "", fmt.Errorf("not an album link: %q", link)
+	}
+	return parts[len(parts)-1], nil
+}
+
+// playlistDiff returns what to remove from and add to current to get the
+// tracks of want. Tracks in both stay where they are; a wanted track that
+// is in the playlist more than once is removed and added back once, as
+// Spotify removes every occurrence. Each uri is listed once.
+func playlistDiff(current, want []string) (remove, add []string) {
+	wanted := map[string]bool{}
+	for _, uri := range want {
+		wanted[uri] = true
+	}
+
+	have := map[string]int{}
+	for _, uri := range current {
+		have[uri]++
+		if have[uri] == 1 && !wanted[uri] || have[uri] == 2 && wanted[uri] {
+			remove = append(remove, uri)
+		}
+	}
+
+	added := map[string]bool{}
+	for _, uri := range want {
+		if (have[uri] == 0 || have[uri] > 1) && !added[uri] {
+			added[uri] = true
+			add = append(add, uri)
+		}
+	}
+	return remove, add
+}
+
+// syncPlaylist makes playlistId hold the tracks of the named selection in
+// the playlist config, with as few changes as possible. It runs as the
+// user connected at /admin/spotify/connect.
+func (app *application) syncPlaylist(ctx context.Context, playlistId, name string) error {
+	path := os.Getenv("PLAYLIST_CONFIG")
+	if path == "" {
+		path = "playlists.json"
+	}
+	selections, err := loadPlaylistSelections(path)
+	if err != nil {
+		return err
+	}
+	s, ok := selections[name]
+	if !ok {
+		return fmt.Errorf("no selection %q in %s", name, path)
+	}
+
+	dc := api.NewDgraphClient(app.conn)
+	dg := dgo.NewDgraphClient(dc)
+
+	albums, err := app.selectAlbums(ctx, dg, s)
+	if err != nil {
+		return err
+	}
+
+	want := []string{}
+	seen := map[string]bool{}
+	for _, a := range albums {
+		id, err := spotifyAlbumId(a.Spotify)
+		if err != nil {
+			log.Printf("Skipping %s (%s): %v", a.Name, a.Uid, err)
+			continue
+		}
+
+		tracks, err := app.spUser.GetAlbumTracks(id)
+		if errors.Is(err, ErrSpotifyNotFound) {
+			log.Printf("Skipping %s (%s): album %s is gone from Spotify", a.Name, a.Uid, id)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		uris := tracks.Uris
+		if s.Tracks == "one" && len(uris) > 1 {
+			uris = uris[:1]
+		}
+		for _, uri := range uris {
+			if !seen[uri] {
+				seen[uri] = true
+				want = append(want, uri)
+			}
+		}
+	}
+
+	current, err := app.spUser.PlaylistTracks(playlistId)
+	if err != nil {
+		return err
+	}
+
+	remove, add := playlistDiff(current, want)
+	if len(remove) > 0 {
+		err = app.spUser.RemoveTracks(playlistId, remove)
+		if err != nil {
+			return err
+		}
+	}
+	if len(add) > 0 {
+		err = app.spUser.AddTracks(playlistId, add)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Synced playlist %s with %s: %d albums, %d tracks, %d removed, %d added", playlistId, name, len(albums), len(want), len(remove), len(add))
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPlaylistDiff(t *testing.T) {
+	tests := []struct {
+		name          string
+		current, want []string
+		remove, add   []string
+	}{
+		{"empty playlist", nil, []string{"a", "b"}, nil, []string{"a", "b"}},
+		{"no changes", []string{"a", "b", "c"}, []string{"a", "b", "c"}, nil, nil},
+		{"new order is not forced", []string{"a", "b"}, []string{"b", "a"}, nil, nil},
+		{"some changes", []string{"a", "b", "c"}, []string{"b", "d"}, []string{"a", "c"}, []string{"d"}},
+		{"complete replacement", []string{"a", "b"}, []string{"c", "d"}, []string{"a", "b"}, []string{"c", "d"}},
+		{"cleared", []string{"a", "b"}, nil, []string{"a", "b"}, nil},
+		{"wanted track twice", []string{"a", "b", "a"}, []string{"a", "b"}, []string{"a"}, []string{"a"}},
+		{"wanted track three times", []string{"a", "a", "a"}, []string{"a"}, []string{"a"}, []string{"a"}},
+		{"unwanted track twice", []string{"a", "c", "c"}, []string{"a"}, []string{"c"}, nil},
+	}
+	for _, tt := range tests {
+		remove, add := playlistDiff(tt.current, tt.want)
+		if !slices.Equal(remove, tt.remove) || !slices.Equal(add, tt.add) {
+			t.Errorf("%s: playlistDiff(%q, %q) = %q, %q, want %q, %q", tt.name, tt.current, tt.want, remove, add, tt.remove, tt.add)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+// viewerSalt hashes client uuids before they are stored on Viewer nodes.
+// The salt is random and replaced at every period boundary, so stored ids
+// cannot be tied to a client or to each other across periods. The salt of
+// the current period is kept in path, so a restart does not split the
+// period; older salts are overwritten.
+type viewerSalt struct {
+	every time.Duration
+	path  string
+
+	mu     sync.Mutex
+	salt   []byte
+	period time.Time
+}
+
+type savedSalt struct {
+	Period time.Time `json:"period"`
+	Salt   []byte    `json:"salt"`
+}
+
+// loadViewerSalt picks up the salt saved in path if it is for the current
+// period. An empty path keeps the salt in memory only.
+func loadViewerSalt(path string, every time.Duration) (*viewerSalt, error) {
+	vs := &viewerSalt{every: every, path: path}
+	if path == "" {
+		return vs, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return vs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved savedSalt
+	err = json.Unmarshal(b, &saved)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(saved.Salt) > 0 && saved.Period.Equal(time.Now().UTC().Truncate(every)) {
+		vs.salt = saved.Salt
+		vs.period = saved.Period
+	}
+	return vs, nil
+}
+
+func (vs *viewerSalt) current(now time.Time) []byte {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	period := now.UTC().Truncate(vs.every)
+	if vs.salt == nil || !period.Equal(vs.period) {
+		vs.salt = randomSalt()
+		vs.period = period
+
+		err := vs.save()
+		if err != nil {
+			log.Println("Error saving viewer salt:", err)
+		}
+	}
+	return vs.salt
+}
+
+// save writes the salt to a temporary file readable only by the owner and
+// renames it into place.
+func (vs *viewerSalt) save() error {
+	if vs.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(savedSalt{Period: vs.period, Salt: vs.salt})
+	if err != nil {
+		return err
+	}
+
+	tmp := vs.path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, vs.path)
+}
+
+func randomSalt() []byte {
+	salt := make([]byte, 32)
+	_, err := rand.Read(salt)
+	if err != nil {
+		panic(err)
+	}
+	return salt
+}
+
+func saltedHash(salt []byte, uuid string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(uuid))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hash is the id stored for uuid in the current period.
+func (vs *viewerSalt) hash(uuid string) string {
+	return saltedHash(vs.current(time.Now()), uuid)
+}
+
+// doNotTrack reports whether the client asked not to be tracked with DNT
+// or Global Privacy Control.
+func doNotTrack(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
+type PurgeEdge struct {
+	Uid string `json:"uid"`
+}
+
+type PurgeNode struct {
+	Uid     string      `json:"uid"`
+	Content []PurgeEdge `json:"content"`
+}
+
+type PurgeResponse struct {
+	Viewers []PurgeNode `json:"viewers"`
+}
+
+// purgeViewers deletes content edges of Viewer nodes read before the
+// retention period, and Viewer nodes left without any. read_count keeps
+// the totals. A retention of zero days keeps everything.
+func (app *application) purgeViewers(ctx context.Context) error {
+	if app.viewerRetention <= 0 {
+		return nil
+	}
+
+	dc := api.NewDgraphClient(app.conn)
+	dg := dgo.NewDgraphClient(dc)
+
+	cutoff := time.Now().AddDate(0, 0, -app.viewerRetention).UTC()
+	q := `query Old($after: string, $first: int) {
+		viewers(func: type(Viewer), first: $first, after: $after) {
+			uid
+			content @facets(lt(time, "` + cutoff.Format(time.RFC3339) + `")) {
+				uid
+			}
+		}
+	}`
+
+	edges := 0
+	after := "0x0"
+	for {
+		txn := dg.NewReadOnlyTxn()
+		res, err := txn.QueryWithVars(ctx, q, map[string]string{"$after": after, "$first": fmt.Sprint(readsPageSize)})
+		txn.Discard(ctx)
+		if err != nil {
+			return err
+		}
+
+		var resp PurgeResponse
+		err = json.Unmarshal(res.Json, &resp)
+		if err != nil {
+			return err
+		}
+
+		var del strings.Builder
+		for _, v := range resp.Viewers {
+			for _, c := range v.Content {
+				fmt.Fprintf(&del, "<%s> <content> <%s> .\n", v.Uid, c.Uid)
+				edges++
+			}
+		}
+		if del.Len() > 0 {
+			err = deleteNquads(ctx, dg, del.String())
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(resp.Viewers) < readsPageSize {
+			break
+		}
+		after = resp.Viewers[len(resp.Viewers)-1].Uid
+	}
+
+	nodes, err := purgeEmptyViewers(ctx, dg)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Purged %d reads and %d viewers older than %s", edges, nodes, cutoff.Format(dateFormat))
+	return nil
+}
+
+// purgeEmptyViewers deletes Viewer nodes without content edges, a page at
+// a time. The type is deleted explicitly so a node whose type is not in the
+// schema still leaves Viewer, and the cursor moves on even if it does not.
+func purgeEmptyViewers(ctx context.Context, dg *dgo.Dgraph) (int, error) {
+	q := `query Empty($after: string, $first: int) {
+		viewers(func: type(Viewer), first: $first, after: $after) @filter(NOT has(content)) {
+			uid
+		}
+	}`
+
+	nodes := 0
+	after := "0x0"
+	for {
+		txn := dg.NewReadOnlyTxn()
+		res, err := txn.QueryWithVars(ctx, q, map[string]string{"$after": after, "$first": fmt.Sprint(readsPageSize)})
+		txn.Discard(ctx)
+		if err != nil {
+			return nodes, err
+		}
+
+		var resp PurgeResponse
+		err = json.Unmarshal(res.Json, &resp)
+		if err != nil {
+			return nodes, err
+		}
+		if len(resp.Viewers) == 0 {
+			return nodes, nil
+		}
+
+		var del strings.Builder
+		for _, v := range resp.Viewers {
+			fmt.Fprintf(&del, "<%s> <dgraph.type> * .\n<%s> * * .\n", v.Uid, v.Uid)
+		}
+		err = deleteNquads(ctx, dg, del.String())
+		if err != nil {
+			return nodes, err
+		}
+		nodes += len(resp.Viewers)
+		after = resp.Viewers[len(resp.Viewers)-1].Uid
+	}
+}
+
+func deleteNquads(ctx context.Context, dg *dgo.Dgraph, nquads string) error {
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	_, err := txn.Mutate(ctx, &api.Mutation{
+		DelNquads: []byte(nquads),
+		CommitNow: true,
+	})
+	return err
+}
+
+type ViewerUuid struct {
+	Uid  string `json:"uid"`
+	Uuid string `json:"uuid"`
+}
+
+type ViewerUuidResponse struct {
+	Viewers []ViewerUuid `json:"viewers"`
+}
+
+// hashViewers replaces the raw client uuids left on Viewer nodes from
+// before they were hashed. It uses a salt that is thrown away afterwards,
+// so the old nodes keep their reads apart but cannot be tied to a client
+// or to any later period.
+func (app *application) hashViewers(ctx context.Context) error {
+	dc := api.NewDgraphClient(app.conn)
+	dg := dgo.NewDgraphClient(dc)
+
+	q := `query Viewers($after: string, $first: int) {
+		viewers(func: type(Viewer), first: $first, after: $after) {
+			uid
+			uuid
+		}
+	}`
+
+	salt := randomSalt()
+	hashed := 0
+	after := "0x0"
+	for {
+		txn := dg.NewReadOnlyTxn()
+		res, err := txn.QueryWithVars(ctx, q, map[string]string{"$after": after, "$first": fmt.Sprint(readsPageSize)})
+		txn.Discard(ctx)
+		if err != nil {
+			return err
+		}
+
+		var resp ViewerUuidResponse
+		err = json.Unmarshal(res.Json, &resp)
+		if err != nil {
+			return err
+		}
+
+		var set strings.Builder
+		for _, v := range resp.Viewers {
+			if validUuid(v.Uuid) {
+				fmt.Fprintf(&set, "<%s> <uuid> %q .\n", v.Uid, saltedHash(salt, v.Uuid))
+				hashed++
+			}
+		}
+		if set.Len() > 0 {
+			txn := dg.NewTxn()
+			_, err = txn.Mutate(ctx, &api.Mutation{
+				SetNquads: []byte(set.String()),
+				CommitNow: true,
+			})
+			txn.Discard(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(resp.Viewers) < readsPageSize {
+			break
+		}
+		after = resp.Viewers[len(resp.Viewers)-1].Uid
+	}
+
+	log.Printf("Hashed the uuids of %d viewers", hashed)
+	return nil
+}
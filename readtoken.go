@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readTokenAge is how long after the page was rendered a read is accepted.
+const readTokenAge = 6 * time.Hour
+
+var (
+	errBadToken = errors.New("bad read token")
+	errTooEarly = errors.New("read reported too early")
+	errExpired  = errors.New("read token expired")
+	errReplayed = errors.New("read already counted")
+)
+
+// readTokens issues and checks the tokens printContent embeds in the page,
+// so a read is only counted for someone who loaded the page and stayed on
+// it for a while.
+type readTokens struct {
+	key      []byte
+	minDwell time.Duration
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// newReadTokens signs with secret. Without a secret a random key is used,
+// which means pages rendered before a restart cannot report reads.
+func newReadTokens(secret string, minDwell time.Duration) *readTokens {
+	key := []byte(secret)
+	if secret == "" {
+		log.Println("READ_TOKEN_SECRET not set, using a random key")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+
+	return &readTokens{
+		key:      key,
+		minDwell: minDwell,
+		used:     map[string]time.Time{},
+	}
+}
+
+func (rt *readTokens) sign(uid, issued, nonce string) string {
+	mac := hmac.New(sha256.New, rt.key)
+	mac.Write([]byte(uid + "|" + issued + "|" + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issue returns a token of the form "issued.nonce.signature" for uid. The
+// nonce keeps tokens for pages rendered in the same second apart.
+func (rt *readTokens) issue(uid string) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	issued := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	return issued + "." + nonce + "." + rt.sign(uid, issued, nonce)
+}
+
+// verify checks the token for uid and marks both the token and the
+// uuid/content/day combination as used.
+func (rt *readTokens) verify(token, uid, uuid string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errBadToken
+	}
+
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return errBadToken
+	}
+
+	if !hmac.Equal([]byte(parts[2]), []byte(rt.sign(uid, parts[0], parts[1]))) {
+		return errBadToken
+	}
+
+	now := time.Now()
+	age := now.Sub(time.Unix(issued, 0))
+	if age < rt.minDwell {
+		return errTooEarly
+	}
+	if age > readTokenAge {
+		return errExpired
+	}
+
+	daily := uuid + "|" + uid + "|" + now.Format("2006-01-02")
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if _, ok := rt.used[token]; ok {
+		return errReplayed
+	}
+	if _, ok := rt.used[daily]; ok {
+		return errReplayed
+	}
+
+	rt.used[token] = time.Unix(issued, 0).Add(readTokenAge)
+	rt.used[daily] = now.Add(24 * time.Hour)
+
+	return nil
+}
+
+// prune forgets the used tokens that have expired. It runs as a job so
+// verify does not walk the map on every read.
+func (rt *readTokens) prune(now time.Time) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for k, expires := range rt.used {
+		if now.After(expires) {
+			delete(rt.used, k)
+		}
+	}
+}
+
+func (app *application) pruneReadTokens(ctx context.Context) error {
+	app.readTokens.prune(time.Now())
+	return nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+)
+
+// cardFields is what the content list templates need for each card.
+const cardFields = `
+				name
+				lead_in_text
+				type
+				uid
+				pic
+				published_at
+				view_count
+				artist {
+					name
+				}
+				written_by {
+					name
+				}`
+
+// Recommender is a source of related content for the content page.
+type Recommender interface {
+	// Name identifies the source in the weights and in the reasons.
+	Name() string
+	// Candidates returns up to n items related to uid, best first.
+	Candidates(ctx context.Context, dg *dgo.Dgraph, uid string, n int) ([]DGraphContent, error)
+	// Rotate tells the engine that the candidates are about equally good,
+	// so it should sample from a larger pool rather than use the top ones.
+	Rotate() bool
+}
+
+// Recommendation is a picked item together with the source that picked it.
+type Recommendation struct {
+	Content DGraphContent
+	Reason  string
+}
+
+type CandidatesResponse struct {
+	Candidates []DGraphContent `json:"candidates"`
+}
+
+// queryRecommender runs a DQL query with the variables $uid and $first that
+// returns its result in a block named candidates.
+type queryRecommender struct {
+	name   string
+	query  string
+	rotate bool
+}
+
+func (qr *queryRecommender) Name() string {
+	return qr.name
+}
+
+func (qr *queryRecommender) Rotate() bool {
+	return qr.rotate
+}
+
+func (qr *queryRecommender) Candidates(ctx context.Context, dg *dgo.Dgraph, uid string, n int) ([]DGraphContent, error) {
+	txn := dg.NewReadOnlyTxn()
+	defer txn.Discard(ctx)
+
+	res, err := txn.QueryWithVars(ctx, qr.query, map[string]string{"$uid": uid, "$first": strconv.Itoa(n)})
+	if err != nil {
+		return nil, err
+	}
+
+	var resp CandidatesResponse
+	err = json.Unmarshal(res.Json, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Candidates, nil
+}
+
+// relatedBy recommends the least read content sharing the given edge with
+// the current content.
+func relatedBy(name, edge string) Recommender {
+	return &queryRecommender{
+		name:   name,
+		rotate: true,
+		query: `query Related($uid: string, $first: int) {
+			var(func: uid($uid)) {
+				` + edge + ` {
+					c as ~` + edge + `
+				}
+			}
+			candidates(func: uid(c), orderasc: read_count, first: $first) @filter(type(Content) AND NOT uid($uid)) {` + cardFields + `
+			}
+		}`,
+	}
+}
+
+func popularRecommender() Recommender {
+	return &queryRecommender{
+		name: "popular",
+		query: `query Popular($uid: string, $first: int) {
+			candidates(func: has(read_count), orderdesc: read_count, first: $first) @filter(type(Content) AND NOT uid($uid)) {` + cardFields + `
+			}
+		}`,
+	}
+}
+
+func freshRecommender() Recommender {
+	return &queryRecommender{
+		name:   "fresh",
+		rotate: true,
+		query: `query Fresh($uid: string, $first: int) {
+			candidates(func: has(read_count), orderasc: read_count, orderasc: view_count, first: $first) @filter(type(Content) AND NOT uid($uid)) {` + cardFields + `
+			}
+		}`,
+	}
+}
+
+// coreadRecommender follows the coread edges computed by computeCoread,
+// most shared readers first.
+func coreadRecommender() Recommender {
+	return &queryRecommender{
+		name: "coread",
+		query: `query Coread($uid: string, $first: int) {
+			var(func: uid($uid)) {
+				coread @facets(n as count)
+			}
+			candidates(func: uid(n), orderdesc: val(n), first: $first) @filter(type(Content) AND NOT uid($uid)) {` + cardFields + `
+			}
+		}`,
+	}
+}
+
+// similarRecommender follows the similar edges computed by
+// computeSimilarity, most similar text first.
+func similarRecommender() Recommender {
+	return &queryRecommender{
+		name: "similar",
+		query: `query Similar($uid: string, $first: int) {
+			var(func: uid($uid)) {
+				similar @facets(s as score)
+			}
+			candidates(func: uid(s), orderdesc: val(s), first: $first) @filter(type(Content) AND NOT uid($uid)) {` + cardFields + `
+			}
+		}`,
+	}
+}
+
+var recommenders = map[string]Recommender{
+	"label":   relatedBy("label", "label"),
+	"artist":  relatedBy("artist", "artist"),
+	"writer":  relatedBy("writer", "written_by"),
+	"popular": popularRecommender(),
+	"fresh":   freshRecommender(),
+	"coread":  coreadRecommender(),
+	"similar": similarRecommender(),
+}
+
+// defaultWeights stays close to the old cascade of 6 from the labels, 4
+// from the artist, 4 from the writer and 2 extra, with room for co-reads
+// and similar texts. Sources that come up short are backfilled by the
+// others.
+const defaultWeights = "label=4,artist=3,writer=2,coread=3,similar=2,fresh=2"
+
+type weightedRecommender struct {
+	Recommender
+	weight float64
+}
+
+// RecommendEngine fills a fixed number of slots from several recommenders,
+// giving each a share of the slots proportional to its weight.
+type RecommendEngine struct {
+	sources []weightedRecommender
+	total   int
+	pools   *poolCache
+	weight  func(DGraphContent) float64
+}
+
+// rotatePoolSize is how many candidates rotating sources sample from.
+const rotatePoolSize = 50
+
+// NewRecommendEngine parses weights of the form "artist=4,writer=3".
+// Rotating sources are cached in pools and sampled by weight.
+func NewRecommendEngine(weights string, total int, pools *poolCache, weight func(DGraphContent) float64) (*RecommendEngine, error) {
+	e := &RecommendEngine{total: total, pools: pools, weight: weight}
+
+	for _, part := range strings.Split(weights, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad recommender weight %q", part)
+		}
+		rec, ok := recommenders[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown recommender %q", name)
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("bad weight for recommender %q: %q", name, value)
+		}
+		if w > 0 {
+			e.sources = append(e.sources, weightedRecommender{rec, w})
+		}
+	}
+
+	if len(e.sources) == 0 {
+		return nil, fmt.Errorf("no recommenders with a positive weight in %q", weights)
+	}
+
+	sort.SliceStable(e.sources, func(i, j int) bool {
+		return e.sources[i].weight > e.sources[j].weight
+	})
+
+	return e, nil
+}
+
+// slots splits total between the sources by weight, handing out what is
+// left after rounding down by largest remainder.
+func (e *RecommendEngine) slots() []int {
+	sum := 0.0
+	for _, s := range e.sources {
+		sum += s.weight
+	}
+
+	slots := make([]int, len(e.sources))
+	rest := make([]float64, len(e.sources))
+	given := 0
+	for i, s := range e.sources {
+		share := float64(e.total) * s.weight / sum
+		slots[i] = int(math.Floor(share))
+		rest[i] = share - float64(slots[i])
+		given += slots[i]
+	}
+
+	order := make([]int, len(e.sources))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return rest[order[i]] > rest[order[j]]
+	})
+	for i := 0; given < e.total; i++ {
+		slots[order[i%len(order)]]++
+		given++
+	}
+
+	return slots
+}
+
+func (e *RecommendEngine) candidates(ctx context.Context, dg *dgo.Dgraph, s Recommender, uid string) ([]DGraphContent, error) {
+	if !s.Rotate() {
+		return s.Candidates(ctx, dg, uid, e.total)
+	}
+
+	pool, err := e.pools.get(s.Name()+"/"+uid, func() ([]DGraphContent, error) {
+		return s.Candidates(ctx, dg, uid, rotatePoolSize)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sampleContent(pool, e.total, e.weight), nil
+}
+
+// Recommend picks content related to uid. Every source first gets its
+// share of the slots, then sources with candidates left fill the slots
+// others could not.
+func (e *RecommendEngine) Recommend(ctx context.Context, dg *dgo.Dgraph, uid string) []Recommendation {
+	candidates := make([][]DGraphContent, len(e.sources))
+
+	var wg sync.WaitGroup
+	for i, s := range e.sources {
+		wg.Add(1)
+		go func(i int, s weightedRecommender) {
+			defer wg.Done()
+			list, err := e.candidates(ctx, dg, s, uid)
+			if err != nil {
+				fmt.Printf("Recommender %s: %v\n", s.Name(), err)
+				return
+			}
+			candidates[i] = list
+		}(i, s)
+	}
+	wg.Wait()
+
+	picked := []Recommendation{}
+	seen := map[string]bool{uid: true}
+	next := make([]int, len(e.sources))
+
+	take := func(i, n int) {
+		for ; n > 0 && next[i] < len(candidates[i]) && len(picked) < e.total; next[i]++ {
+			c := candidates[i][next[i]]
+			if seen[c.Uid] {
+				continue
+			}
+			seen[c.Uid] = true
+			picked = append(picked, Recommendation{Content: c, Reason: e.sources[i].Name()})
+			n--
+		}
+	}
+
+	for i, n := range e.slots() {
+		take(i, n)
+	}
+
+	for progress := true; progress && len(picked) < e.total; {
+		progress = false
+		for i := range e.sources {
+			before := len(picked)
+			take(i, 1)
+			if len(picked) > before {
+				progress = true
+			}
+		}
+	}
+
+	return picked
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+// legacyRoute describes one family of URLs from the old PHP site.
+type legacyRoute struct {
+	param  string // query parameter holding the identifier
+	prefix string // prefix of the oldId the identifier is stored with
+	kind   string // content, artist, writer or start
+}
+
+var legacyRoutes = map[string]legacyRoute{
+	"/index.php":     {kind: "start"},
+	"/recension.php": {param: "id", prefix: "r", kind: "content"},
+	"/artikel.php":   {param: "id", prefix: "f", kind: "content"},
+	"/artist.php":    {param: "id", prefix: "a", kind: "artist"},
+	"/skribent.php":  {param: "id", prefix: "s", kind: "writer"},
+}
+
+type LegacyTarget struct {
+	Uid  string `json:"uid"`
+	Name string `json:"name"`
+}
+
+type LegacyResponse struct {
+	Target []LegacyTarget `json:"target"`
+}
+
+// redirectMap holds static old -> new redirects loaded from REDIRECT_MAP.
+type redirectMap struct {
+	entries map[string]string
+}
+
+// loadRedirectMap reads a file with one "old new" pair per line. Blank
+// lines and lines starting with # are ignored. The old side is matched
+// against the request URI first and the bare path second.
+func loadRedirectMap(path string) (*redirectMap, error) {
+	m := &redirectMap{entries: map[string]string{}}
+	if path == "" {
+		return m, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected two fields, got %d", path, line, len(fields))
+		}
+		m.entries[fields[0]] = fields[1]
+	}
+
+	return m, scanner.Err()
+}
+
+func (m *redirectMap) lookup(r *http.Request) (string, bool) {
+	if to, ok := m.entries[r.URL.RequestURI()]; ok {
+		return to, true
+	}
+	to, ok := m.entries[r.URL.Path]
+	return to, ok
+}
+
+// isLegacy reports whether the request looks like it was meant for the old
+// PHP site.
+func isLegacy(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, ".php")
+}
+
+func (app *application) legacy(w http.ResponseWriter, r *http.Request) {
+	if to, ok := app.redirects.lookup(r); ok {
+		http.Redirect(w, r, to, http.StatusMovedPermanently)
+		return
+	}
+
+	route, ok := legacyRoutes[r.URL.Path]
+	if !ok {
+		// Scanners probe for wp-login.php and friends, not worth keeping.
+		http.NotFound(w, r)
+		return
+	}
+
+	value := r.URL.Query().Get(route.param)
+	if route.param != "" && value == "" {
+		app.unmatchedLegacy(w, r)
+		return
+	}
+
+	to := ""
+	switch route.kind {
+	case "start":
+		to = "/"
+	default:
+		dc := api.NewDgraphClient(app.conn)
+		dg := dgo.NewDgraphClient(dc)
+
+		target, err := resolveLegacy(route, value, dg, r.Context())
+		if err != nil {
+			fmt.Println(err)
+		}
+		if target == nil {
+			app.unmatchedLegacy(w, r)
+			return
+		}
+
+		switch route.kind {
+		case "content":
+			to = contentPath(target.Uid, target.Name)
+		case "artist":
+			to = artistPath(target.Uid, target.Name)
+		case "writer":
+			to = writerPath(target.Uid, target.Name)
+		}
+	}
+
+	http.Redirect(w, r, to, http.StatusMovedPermanently)
+}
+
+// legacyOldId is the oldId the importer stored for the identifier of an
+// old URL, such as "r-123" for /recension.php?id=123.
+func legacyOldId(route legacyRoute, value string) string {
+	return fmt.Sprintf("%s-%s", route.prefix, value)
+}
+
+func resolveLegacy(route legacyRoute, value string, dg *dgo.Dgraph, ctx context.Context) (*LegacyTarget, error) {
+	q := `query Legacy($terms: string) {
+		target (func: eq(oldId, $terms), first: 1) {
+			uid
+			name
+		}
+	}`
+	terms := legacyOldId(route, value)
+
+	txn := dg.NewReadOnlyTxn()
+	defer txn.Discard(ctx)
+
+	res, err := txn.QueryWithVars(ctx, q, map[string]string{"$terms": terms})
+	if err != nil {
+		return nil, err
+	}
+
+	var resp LegacyResponse
+	err = json.Unmarshal(res.Json, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Target) != 1 {
+		return nil, nil
+	}
+
+	return &resp.Target[0], nil
+}
+
+// unmatchedLegacy records hits on old routes we could not resolve so they
+// can be reviewed and added to the redirect map. Bots are not recorded.
+func (app *application) unmatchedLegacy(w http.ResponseWriter, r *http.Request) {
+	if isBot(r.Context()) {
+		app.bots.count("legacy")
+	} else {
+		app.legacyMisses.record(r.URL.RequestURI(), r.Referer(), time.Now())
+	}
+
+	http.NotFound(w, r)
+}
+
+// maxLegacyMisses bounds how many different URLs are kept.
+const maxLegacyMisses = 10000
+
+type legacyMiss struct {
+	Uri     string
+	Referer string
+	Count   int64
+	First   time.Time
+	Last    time.Time
+}
+
+// legacyMisses counts unresolved legacy URLs and is saved to a tab file
+// with one line per URL: uri, count, first and last seen, and the first
+// referer.
+type legacyMisses struct {
+	mu      sync.Mutex
+	path    string
+	misses  map[string]*legacyMiss
+	dropped int64
+}
+
+// loadLegacyMisses reads the counts saved at path. Lines from the old
+// append-only log, "time uri referer", are counted as they are read.
+func loadLegacyMisses(path string) (*legacyMisses, error) {
+	lm := &legacyMisses{path: path, misses: map[string]*legacyMiss{}}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return lm, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		switch len(fields) {
+		case 3:
+			at, err := time.Parse(time.RFC3339, fields[0])
+			if err == nil {
+				lm.add(fields[1], fields[2], 1, at, at)
+			}
+		case 5:
+			count, err := strconv.ParseInt(fields[1], 10, 64)
+			first, err1 := time.Parse(time.RFC3339, fields[2])
+			last, err2 := time.Parse(time.RFC3339, fields[3])
+			if err == nil && err1 == nil && err2 == nil {
+				lm.add(fields[0], fields[4], count, first, last)
+			}
+		}
+	}
+
+	return lm, scanner.Err()
+}
+
+// add must be called with lm.mu held, or before lm is shared.
+func (lm *legacyMisses) add(uri, referer string, count int64, first, last time.Time) {
+	m, ok := lm.misses[uri]
+	if !ok {
+		if len(lm.misses) >= maxLegacyMisses {
+			lm.dropped += count
+			return
+		}
+		m = &legacyMiss{Uri: uri, Referer: referer, First: first}
+		lm.misses[uri] = m
+	}
+	m.Count += count
+	if first.Before(m.First) {
+		m.First = first
+	}
+	if last.After(m.Last) {
+		m.Last = last
+	}
+	if m.Referer == "" {
+		m.Referer = referer
+	}
+}
+
+func (lm *legacyMisses) record(uri, referer string, now time.Time) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	if _, ok := lm.misses[uri]; !ok {
+		log.Printf("Unmatched legacy URL: %s (referer %q)", uri, referer)
+	}
+	lm.add(uri, referer, 1, now, now)
+}
+
+// save writes the counts, most hit first, to a temporary file and renames
+// it into place.
+func (lm *legacyMisses) save() error {
+	if lm.path == "" {
+		return nil
+	}
+
+	lm.mu.Lock()
+	misses := make([]legacyMiss, 0, len(lm.misses))
+	for _, m := range lm.misses {
+		misses = append(misses, *m)
+	}
+	dropped := lm.dropped
+	lm.mu.Unlock()
+
+	sort.Slice(misses, func(i, j int) bool {
+		if misses[i].Count != misses[j].Count {
+			return misses[i].Count > misses[j].Count
+		}
+		return misses[i].Uri < misses[j].Uri
+	})
+
+	var b strings.Builder
+	for _, m := range misses {
+		fmt.Fprintf(&b, "%s\t%d\t%s\t%s\t%s\n", m.Uri, m.Count, m.First.Format(time.RFC3339), m.Last.Format(time.RFC3339), m.Referer)
+	}
+	if dropped > 0 {
+		log.Printf("%d legacy hits not kept, over %d different URLs", dropped, maxLegacyMisses)
+	}
+
+	tmp := lm.path + ".tmp"
+	err := os.WriteFile(tmp, []byte(b.String()), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, lm.path)
+}
+
+func (app *application) saveLegacyMisses(ctx context.Context) error {
+	return app.legacyMisses.save()
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestLegacyOldId(t *testing.T) {
+	tests := []struct {
+		path, id, want string
+	}{
+		{"/recension.php", "4711", "r-4711"},
+		{"/artikel.php", "12", "f-12"},
+		{"/artist.php", "830", "a-830"},
+		{"/skribent.php", "7", "s-7"},
+	}
+	for _, tt := range tests {
+		route, ok := legacyRoutes[tt.path]
+		if !ok {
+			t.Errorf("no legacy route for %s", tt.path)
+			continue
+		}
+		if got := legacyOldId(route, tt.id); got != tt.want {
+			t.Errorf("legacyOldId(%s, %s) = %q, want %q", tt.path, tt.id, got, tt.want)
+		}
+	}
+}
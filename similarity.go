@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+const (
+	// similarNeighbours is how many similar edges are kept per content.
+	similarNeighbours = 20
+	// similarTerms caps the vector of each text to its strongest terms,
+	// which keeps the pairwise comparison cheap without changing the top
+	// neighbours much.
+	similarTerms   = 100
+	similarMinimum = 0.05
+	textPageSize   = 500
+)
+
+var (
+	markupPattern = regexp.MustCompile(`\[/?[a-z]+[^\]]*\]`)
+	urlPattern    = regexp.MustCompile(`https?://\S+`)
+)
+
+type ContentText struct {
+	Uid  string `json:"uid"`
+	Text string `json:"text"`
+}
+
+type ContentTextResponse struct {
+	Content []ContentText `json:"content"`
+}
+
+type termWeight struct {
+	term   string
+	weight float64
+}
+
+// plainText removes the forum style markup and links from a text.
+func plainText(input string) string {
+	input = markupPattern.ReplaceAllString(input, " ")
+	input = urlPattern.ReplaceAllString(input, " ")
+	return input
+}
+
+// tokenize splits a text into stemmed Swedish terms, skipping stop words,
+// numbers and very short words.
+func tokenize(input string) []string {
+	words := strings.FieldsFunc(strings.ToLower(plainText(input)), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+
+	terms := []string{}
+	for _, w := range words {
+		if len([]rune(w)) < 3 || swedishStopwords[w] {
+			continue
+		}
+		terms = append(terms, stemSwedish(w))
+	}
+	return terms
+}
+
+// tfidf builds L2 normalized TF-IDF vectors, keeping the strongest terms of
+// each document. Terms in only one document, or in more than half of them,
+// say nothing about similarity and are dropped.
+func tfidf(docs map[string][]string) map[string][]termWeight {
+	df := map[string]int{}
+	for _, terms := range docs {
+		seen := map[string]bool{}
+		for _, t := range terms {
+			if !seen[t] {
+				seen[t] = true
+				df[t]++
+			}
+		}
+	}
+
+	n := float64(len(docs))
+	vectors := map[string][]termWeight{}
+	for uid, terms := range docs {
+		tf := map[string]int{}
+		for _, t := range terms {
+			tf[t]++
+		}
+
+		vec := []termWeight{}
+		for t, count := range tf {
+			if df[t] < 2 || float64(df[t]) > n/2 {
+				continue
+			}
+			vec = append(vec, termWeight{t, (1 + math.Log(float64(count))) * math.Log(n/float64(df[t]))})
+		}
+
+		sort.Slice(vec, func(i, j int) bool {
+			if vec[i].weight != vec[j].weight {
+				return vec[i].weight > vec[j].weight
+			}
+			return vec[i].term < vec[j].term
+		})
+		if len(vec) > similarTerms {
+			vec = vec[:similarTerms]
+		}
+
+		norm := 0.0
+		for _, tw := range vec {
+			norm += tw.weight * tw.weight
+		}
+		if norm == 0 {
+			continue
+		}
+		norm = math.Sqrt(norm)
+		for i := range vec {
+			vec[i].weight /= norm
+		}
+		vectors[uid] = vec
+	}
+
+	return vectors
+}
+
+// nearestNeighbours computes the cosine similarity between all vectors
+// through an inverted index and keeps the top n per document.
+func nearestNeighbours(vectors map[string][]termWeight, n int) map[string][]scoredEdge {
+	type posting struct {
+		uid    string
+		weight float64
+	}
+
+	index := map[string][]posting{}
+	for uid, vec := range vectors {
+		for _, tw := range vec {
+			index[tw.term] = append(index[tw.term], posting{uid, tw.weight})
+		}
+	}
+
+	edges := map[string][]scoredEdge{}
+	for uid, vec := range vectors {
+		scores := map[string]float64{}
+		for _, tw := range vec {
+			for _, p := range index[tw.term] {
+				if p.uid != uid {
+					scores[p.uid] += tw.weight * p.weight
+				}
+			}
+		}
+		for other, score := range scores {
+			if score < similarMinimum {
+				delete(scores, other)
+			} else {
+				scores[other] = math.Round(score*1000) / 1000
+			}
+		}
+		if len(scores) > 0 {
+			edges[uid] = topEdges(scores, n)
+		}
+	}
+
+	return edges
+}
+
+// computeSimilarity stores the textually most similar content of every
+// content as similar edges with the cosine similarity as a facet.
+func (app *application) computeSimilarity(ctx context.Context) error {
+	dc := api.NewDgraphClient(app.conn)
+	dg := dgo.NewDgraphClient(dc)
+
+	q := `query Texts($after: string, $first: int) {
+		content(func: type(Content), first: $first, after: $after) @filter(has(text)) {
+			uid
+			text
+		}
+	}`
+
+	docs := map[string][]string{}
+	after := "0x0"
+	for {
+		txn := dg.NewReadOnlyTxn()
+		res, err := txn.QueryWithVars(ctx, q, map[string]string{"$after": after, "$first": fmt.Sprint(textPageSize)})
+		txn.Discard(ctx)
+		if err != nil {
+			return err
+		}
+
+		var resp ContentTextResponse
+		err = json.Unmarshal(res.Json, &resp)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range resp.Content {
+			docs[c.Uid] = tokenize(c.Text)
+		}
+
+		if len(resp.Content) < textPageSize {
+			break
+		}
+		after = resp.Content[len(resp.Content)-1].Uid
+	}
+
+	fmt.Printf("Computing similarity for %d texts\n", len(docs))
+
+	return replaceEdges(ctx, dg, "similar", "score", nearestNeighbours(tfidf(docs), similarNeighbours))
+}
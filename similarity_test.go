@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTfidf(t *testing.T) {
+	tests := []struct {
+		name string
+		docs map[string][]string
+		// want is the terms of each vector, strongest first. Documents
+		// missing from want get no vector.
+		want map[string][]string
+	}{
+		{
+			name: "rare and common terms dropped",
+			docs: map[string][]string{
+				"a": {"rock", "blues", "blues", "gitarr"},
+				"b": {"rock", "blues", "gitarr"},
+				"c": {"jazz", "gitarr", "saxofon"},
+				"d": {"jazz", "soul"},
+			},
+			want: map[string][]string{
+				"a": {"blues", "rock"},
+				"b": {"blues", "rock"},
+				"c": {"jazz"},
+				"d": {"jazz"},
+			},
+		},
+		{
+			name: "document without shared terms",
+			docs: map[string][]string{
+				"a": {"rock", "blues"},
+				"b": {"rock", "blues"},
+				"c": {"polka"},
+				"d": {"tango"},
+			},
+			want: map[string][]string{
+				"a": {"blues", "rock"},
+				"b": {"blues", "rock"},
+			},
+		},
+		{
+			name: "single document",
+			docs: map[string][]string{"a": {"rock", "rock"}},
+			want: map[string][]string{},
+		},
+	}
+	for _, tt := range tests {
+		got := tfidf(tt.docs)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got vectors for %d documents, want %d", tt.name, len(got), len(tt.want))
+		}
+		for uid, terms := range tt.want {
+			vec := got[uid]
+			if len(vec) != len(terms) {
+				t.Errorf("%s: %s = %v, want terms %v", tt.name, uid, vec, terms)
+				continue
+			}
+
+			norm := 0.0
+			for i, tw := range vec {
+				if tw.term != terms[i] {
+					t.Errorf("%s: %s term %d = %q, want %q", tt.name, uid, i, tw.term, terms[i])
+				}
+				norm += tw.weight * tw.weight
+			}
+			if math.Abs(norm-1) > 1e-9 {
+				t.Errorf("%s: %s has norm %v, want 1", tt.name, uid, norm)
+			}
+		}
+	}
+}
+
+func TestTfidfWeights(t *testing.T) {
+	vectors := tfidf(map[string][]string{
+		"a": {"rock", "blues", "blues"},
+		"b": {"rock", "blues"},
+		"c": {"jazz"},
+		"d": {"jazz"},
+	})
+
+	// Both terms have the same idf, so the weights only differ by the
+	// sublinear tf: 1 + ln 2 against 1.
+	blues, rock := 1+math.Ln2, 1.0
+	norm := math.Hypot(blues, rock)
+	want := []termWeight{{"blues", blues / norm}, {"rock", rock / norm}}
+
+	got := vectors["a"]
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].term != want[i].term || math.Abs(got[i].weight-want[i].weight) > 1e-9 {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
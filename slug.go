@@ -0,0 +1,62 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// foldMap transliterates the non-ASCII letters that show up in artist and
+// album names to their closest ASCII form.
+var foldMap = map[rune]string{
+	'å': "a", 'ä': "a", 'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ā': "a",
+	'æ': "ae",
+	'ç': "c", 'č': "c", 'ć': "c",
+	'é': "e", 'è': "e", 'ê': "e", 'ë': "e", 'ę': "e", 'ě': "e",
+	'í': "i", 'ì': "i", 'î': "i", 'ï': "i",
+	'ñ': "n", 'ń': "n",
+	'ö': "o", 'ø': "o", 'ó': "o", 'ò': "o", 'ô': "o", 'õ': "o", 'ő': "o",
+	'ú': "u", 'ù': "u", 'û': "u", 'ü': "u", 'ű': "u",
+	'ý': "y", 'ÿ': "y",
+	'š': "s", 'ś': "s", 'ß': "ss",
+	'ž': "z", 'ź': "z", 'ż': "z",
+	'ł': "l", 'ð': "d", 'þ': "th",
+}
+
+var slugStrip = regexp.MustCompile(`[^a-z0-9]+`)
+
+// foldText lower cases the input and replaces accented letters with their
+// ASCII counterparts, so "Åsa Öberg" becomes "asa oberg".
+func foldText(input string) string {
+	var b strings.Builder
+
+	for _, r := range strings.ToLower(input) {
+		if f, ok := foldMap[r]; ok {
+			b.WriteString(f)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// toUrl builds the slug used in /content/{uid}/{slug} and /artist/{uid}/{slug}.
+func toUrl(name string) string {
+	return strings.Trim(slugStrip.ReplaceAllString(foldText(name), "-"), "-")
+}
+
+func contentPath(uid, name string) string {
+	return "/content/" + uid + "/" + toUrl(name)
+}
+
+func artistPath(uid, name string) string {
+	return "/artist/" + uid + "/" + toUrl(name)
+}
+
+func writerPath(uid, name string) string {
+	return "/writer/" + uid + "/" + toUrl(name)
+}
+
+func labelPath(uid, name string) string {
+	return "/label/" + uid + "/" + toUrl(name)
+}
@@ -4,23 +4,75 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Spotify struct {
-	id      string
-	secret  string
+	id     string
+	secret string
+
+	mu      sync.Mutex
 	token   string
-	expires int64
+	expires time.Time
+
+	// tokenFile holds the refresh token of the connected user. When set,
+	// requests are made as that user instead of as the app.
+	tokenFile string
+	refresh   string
+
+	accountsURL string
+	apiURL      string
+
+	// client sends Web API requests through spotifyTransport, http is
+	// used for the token endpoint.
+	client *http.Client
+	http   *http.Client
+}
+
+// SpotifyOpt changes how NewSpotify sets up the client.
+type SpotifyOpt func(*Spotify)
+
+// WithAccountsURL points token requests somewhere else than
+// https://accounts.spotify.com, such as a fake server.
+func WithAccountsURL(u string) SpotifyOpt {
+	return func(sp *Spotify) {
+		sp.accountsURL = strings.TrimSuffix(u, "/")
+	}
+}
+
+// WithAPIURL points Web API requests somewhere else than
+// https://api.spotify.com.
+func WithAPIURL(u string) SpotifyOpt {
+	return func(sp *Spotify) {
+		sp.apiURL = strings.TrimSuffix(u, "/")
+	}
+}
+
+// WithTransport sends all requests through rt instead of
+// http.DefaultTransport.
+func WithTransport(rt http.RoundTripper) SpotifyOpt {
+	return func(sp *Spotify) {
+		sp.http.Transport = rt
+	}
+}
+
+// WithUserToken makes requests as the user whose refresh token is kept
+// in path, which Connect writes. Spotify only lets users change
+// playlists.
+func WithUserToken(path string) SpotifyOpt {
+	return func(sp *Spotify) {
+		sp.tokenFile = path
+	}
 }
 
 type LoginResponse struct {
-	AccessToken string `json:"access_token"`
-	Duration    int64  `json:"expires_in"`
+	AccessToken  string `json:"access_token"`
+	Duration     int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 type SearchResponse struct {
@@ -54,66 +106,124 @@ type SearchResponse struct {
 	} `json:"albums"`
 }
 
-type TrackListResponse struct {
-	Items []struct {
-		Track struct {
-			Uri string `json:"uri"`
-		} `json:"track"`
-	} `json:"items"`
+// Page is one page of a Spotify paging object. Next is empty on the last
+// page.
+type Page[T any] struct {
+	Items []T    `json:"items"`
+	Next  string `json:"next"`
+	Total int    `json:"total"`
+}
+
+type TrackUri struct {
+	Uri string `json:"uri"`
 }
-type AlbumTrackListResponse struct {
-	Items []struct {
-		Uri string `json:"uri"`
-	} `json:"items"`
+
+type PlaylistItem struct {
+	Track TrackUri `json:"track"`
 }
 
 type TrackListReq struct {
-	Tracks []struct {
-		Uri string `json:"uri"`
-	} `json:"tracks"`
+	Tracks []TrackUri `json:"tracks"`
 }
 
 type AddTracksToPlaylist struct {
 	Uris []string `json:"uris"`
 }
 
+// maxTracksPerRequest is the most tracks Spotify takes in one add or
+// remove call.
+const maxTracksPerRequest = 100
+
 type SpotifyOption struct {
 	Url   string
 	Name  string
 	Image string
+
+	Artists []string
+	Album   string
+	// Year is the release year, 0 when Spotify does not say.
+	Year   int
+	Tracks int
+	// Type is Spotify's album_type: album, single or compilation.
+	Type string
+	// Editions is how many other editions of the album were folded into
+	// this one.
+	Editions int
+	// Score is the match confidence, set by scoreOptions.
+	Score float64
 }
 
-func NewSpotify(id, secret string) (*Spotify, error) {
-	ctx := Spotify{
-		id:     id,
-		secret: secret,
+// NewSpotify sets up a client credentials client. It logs in on the first
+// request, call Login to check the credentials up front.
+func NewSpotify(id, secret string, opts ...SpotifyOpt) (*Spotify, error) {
+	if id == "" || secret == "" {
+		return nil, fmt.Errorf("spotify: client id and secret must be set")
 	}
 
-	err := ctx.Login()
+	sp := &Spotify{
+		id:          id,
+		secret:      secret,
+		accountsURL: "https://accounts.spotify.com",
+		apiURL:      "https://api.spotify.com",
+		http:        &http.Client{Timeout: spotifyTimeout},
+	}
+	for _, opt := range opts {
+		opt(sp)
+	}
 
-	if err != nil {
-		return nil, err
+	base := sp.http.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	sp.client = &http.Client{
+		Timeout:   spotifyTimeout,
+		Transport: &spotifyTransport{sp: sp, base: base},
 	}
 
-	return &ctx, nil
+	return sp, nil
 }
 
+// Login fetches a new client credentials token, or a user token when the
+// client was set up WithUserToken.
 func (sp *Spotify) Login() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	return sp.login()
+}
+
+// login must be called with sp.mu held.
+func (sp *Spotify) login() error {
 	v := url.Values{}
-	// rant_type=client_credentials&client_id=&client_secret=
+	if sp.tokenFile != "" {
+		// Read the file every time: the server and the commands share it
+		// and Spotify may have rotated the token in another process.
+		t, err := readUserToken(sp.tokenFile)
+		if err != nil {
+			return err
+		}
+		sp.refresh = t.RefreshToken
+		v.Set("grant_type", "refresh_token")
+		v.Set("refresh_token", sp.refresh)
+		v.Set("client_id", sp.id)
+	} else {
+		v.Set("grant_type", "client_credentials")
+		v.Set("client_id", sp.id)
+		v.Set("client_secret", sp.secret)
+	}
 
-	v.Set("grant_type", "client_credentials")
-	v.Set("client_id", sp.id)
-	v.Set("client_secret", sp.secret)
-	resp, err := http.PostForm("https://accounts.spotify.com/api/token", v)
+	return sp.requestToken(v)
+}
 
+// requestToken posts v to the token endpoint and keeps the token. A new
+// refresh token replaces the stored one.
+func (sp *Spotify) requestToken(v url.Values) error {
+	resp, err := sp.http.PostForm(sp.accountsURL+"/api/token", v)
 	if err != nil {
 		return err
 	}
 
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-
+	body, err := readResponse(resp)
 	if err != nil {
 		return err
 	}
@@ -126,259 +236,200 @@ func (sp *Spotify) Login() error {
 	}
 
 	sp.token = cred.AccessToken
-	sp.expires = time.Now().Unix() + cred.Duration
+	sp.expires = time.Now().Add(time.Duration(cred.Duration) * time.Second)
+
+	if cred.RefreshToken != "" && cred.RefreshToken != sp.refresh && sp.tokenFile != "" {
+		sp.refresh = cred.RefreshToken
+		err = writeUserToken(sp.tokenFile, UserToken{
+			RefreshToken: cred.RefreshToken,
+			SavedAt:      time.Now().UTC(),
+		})
+		if err != nil {
+			return fmt.Errorf("saving the refresh token: %w", err)
+		}
+	}
 
 	return nil
 }
 
-func (sp *Spotify) getDeleteReq(playlistId string) (*TrackListReq, error) {
-	url := "https://api.spotify.com/v1/playlists/" + playlistId + "/tracks"
-
-	http_client := http.Client{
-		Timeout: time.Second * 5, // Timeout after 5 seconds
-	}
-
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sp.token))
-
-	q := req.URL.Query()
-	q.Add("fields", "items.track.uri")
-
-	req.URL.RawQuery = q.Encode()
-
-	res, getErr := http_client.Do(req)
-	if getErr != nil {
-		return nil, getErr
-	}
-
-	if res.Body != nil {
-		defer res.Body.Close()
-	}
-
-	body, readErr := io.ReadAll(res.Body)
-	if readErr != nil {
-		return nil, readErr
-	}
-
-	found := TrackListResponse{}
-	list := TrackListReq{}
+// accessToken returns the current token, logging in again when it is
+// about to expire.
+func (sp *Spotify) accessToken() (string, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
 
-	jsonErr := json.Unmarshal(body, &found)
-	if jsonErr != nil {
-		return nil, jsonErr
-	}
-
-	for _, t := range found.Items {
-		list.Tracks = append(list.Tracks, t.Track)
+	if sp.token == "" || time.Now().After(sp.expires.Add(-tokenMargin)) {
+		err := sp.login()
+		if err != nil {
+			return "", err
+		}
 	}
-
-	return &list, nil
+	return sp.token, nil
 }
 
-func (sp *Spotify) GetAlbumTracks(albumId string) (*AddTracksToPlaylist, error) {
-	url := "https://api.spotify.com/v1/albums/" + albumId + "/tracks"
+// refreshToken replaces a token Spotify rejected. When several requests
+// fail on the same token only the first logs in again.
+func (sp *Spotify) refreshToken(stale string) (string, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
 
-	http_client := http.Client{
-		Timeout: time.Second * 5, // Timeout after 5 seconds
+	if sp.token != stale {
+		return sp.token, nil
 	}
-
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	err := sp.login()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sp.token))
-
-	res, getErr := http_client.Do(req)
-	if getErr != nil {
-		return nil, getErr
-	}
-
-	if res.Body != nil {
-		defer res.Body.Close()
-	}
-
-	body, readErr := io.ReadAll(res.Body)
-	if readErr != nil {
-		return nil, readErr
-	}
-
-	found := AlbumTrackListResponse{}
-	list := AddTracksToPlaylist{}
-
-	jsonErr := json.Unmarshal(body, &found)
-	if jsonErr != nil {
-		return nil, jsonErr
-	}
-
-	for _, t := range found.Items {
-		list.Uris = append(list.Uris, t.Uri)
-	}
-
-	return &list, nil
+	return sp.token, nil
 }
 
-func (sp *Spotify) AddAlbumToPlaylist(playlistId, albumId string) error {
-	url := "https://api.spotify.com/v1/playlists/" + playlistId + "/tracks"
-
-	http_client := http.Client{
-		Timeout: time.Second * 5, // Timeout after 5 seconds
-	}
-
-	addReq, err := sp.GetAlbumTracks(albumId)
+// get fetches a Web API url into v.
+func (sp *Spotify) get(url string, query url.Values, v any) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return err
 	}
-
-	sendBody, err := json.Marshal(addReq)
-	if err != nil {
-		return err
+	if query != nil {
+		req.URL.RawQuery = query.Encode()
 	}
 
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(sendBody))
+	res, err := sp.client.Do(req)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sp.token))
-	req.Header.Set("Content-Type", "application/json")
-
-	res, err := http_client.Do(req)
 
+	body, err := readResponse(res)
 	if err != nil {
 		return err
 	}
 
-	if res.Body != nil {
-		defer res.Body.Close()
-	}
-
-	if res.StatusCode != 200 {
-		return fmt.Errorf("Bad response code when adding the tracks: %d", res.StatusCode)
-	}
-
-	return nil
+	return json.Unmarshal(body, v)
 }
 
-func (sp *Spotify) ClearPlaylist(playlistId string) error {
-	url := "https://api.spotify.com/v1/playlists/" + playlistId + "/tracks"
-
-	http_client := http.Client{
-		Timeout: time.Second * 5, // Timeout after 5 seconds
-	}
-
-	deleteReq, err := sp.getDeleteReq(playlistId)
-	if err != nil {
-		return err
-	}
-
-	sendBody, err := json.Marshal(deleteReq)
+// send posts or deletes a JSON body.
+func (sp *Spotify) send(method, url string, v any) error {
+	sendBody, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest(http.MethodDelete, url, bytes.NewReader(sendBody))
+	req, err := http.NewRequest(method, url, bytes.NewReader(sendBody))
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sp.token))
 	req.Header.Set("Content-Type", "application/json")
 
-	res, err := http_client.Do(req)
-
+	res, err := sp.client.Do(req)
 	if err != nil {
 		return err
 	}
 
-	if res.Body != nil {
-		defer res.Body.Close()
-	}
-
-	if res.StatusCode != 200 {
-		return fmt.Errorf("Bad response code when deleting the tracks: %d", res.StatusCode)
-	}
-
-	return nil
+	_, err = readResponse(res)
+	return err
 }
 
-func (sp *Spotify) Search(artist, album string) ([]SpotifyOption, error) {
+// pages fetches u and follows the next links, handing the items of each
+// page to fn.
+func pages[T any](sp *Spotify, u string, query url.Values, fn func([]T) error) error {
+	for u != "" {
+		var p Page[T]
+		err := sp.get(u, query, &p)
+		if err != nil {
+			return err
+		}
 
-	if time.Now().Unix() > sp.expires-5 {
-		err := sp.Login()
+		err = fn(p.Items)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		// The next link carries the query.
+		u, query = p.Next, nil
 	}
+	return nil
+}
 
-	url := "https://api.spotify.com/v1/search"
-
-	http_client := http.Client{
-		Timeout: time.Second * 5, // Timeout after 5 seconds
+// chunks splits uris into slices of at most maxTracksPerRequest.
+func chunks(uris []string) [][]string {
+	out := [][]string{}
+	for len(uris) > maxTracksPerRequest {
+		out = append(out, uris[:maxTracksPerRequest])
+		uris = uris[maxTracksPerRequest:]
 	}
-
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
+	if len(uris) > 0 {
+		out = append(out, uris)
 	}
+	return out
+}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sp.token))
+// PlaylistTracks returns the track uris of a playlist, in order.
+func (sp *Spotify) PlaylistTracks(playlistId string) ([]string, error) {
+	uris := []string{}
+	query := url.Values{"fields": {"items.track.uri,next"}, "limit": {"100"}}
 
-	q := req.URL.Query()
-	if strings.HasPrefix(artist, "Blandade") || strings.HasPrefix(artist, "Various") {
-		q.Add("q", album)
-	} else {
-		q.Add("q", fmt.Sprintf("%s artist:%s", album, artist))
+	err := pages(sp, sp.apiURL+"/v1/playlists/"+playlistId+"/tracks", query, func(items []PlaylistItem) error {
+		for _, t := range items {
+			if t.Track.Uri != "" {
+				uris = append(uris, t.Track.Uri)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	q.Add("type", "album")
-	q.Add("limit", "15")
 
-	req.URL.RawQuery = q.Encode()
-
-	res, getErr := http_client.Do(req)
-	if getErr != nil {
-		return nil, getErr
-	}
+	return uris, nil
+}
 
-	if res.Body != nil {
-		defer res.Body.Close()
-	}
+func (sp *Spotify) GetAlbumTracks(albumId string) (*AddTracksToPlaylist, error) {
+	list := AddTracksToPlaylist{}
 
-	body, readErr := io.ReadAll(res.Body)
-	if readErr != nil {
-		return nil, readErr
+	err := pages(sp, sp.apiURL+"/v1/albums/"+albumId+"/tracks", url.Values{"limit": {"50"}}, func(items []TrackUri) error {
+		for _, t := range items {
+			list.Uris = append(list.Uris, t.Uri)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	//fmt.Println(string(body))
-
-	found := SearchResponse{}
+	return &list, nil
+}
 
-	jsonErr := json.Unmarshal(body, &found)
-	if jsonErr != nil {
-		return nil, jsonErr
+// AddTracks appends uris to a playlist, maxTracksPerRequest at a time.
+func (sp *Spotify) AddTracks(playlistId string, uris []string) error {
+	for _, chunk := range chunks(uris) {
+		err := sp.send(http.MethodPost, sp.apiURL+"/v1/playlists/"+playlistId+"/tracks", AddTracksToPlaylist{Uris: chunk})
+		if err != nil {
+			return fmt.Errorf("adding the tracks: %w", err)
+		}
 	}
+	return nil
+}
 
-	opts := []SpotifyOption{}
-	for _, a := range found.Albums.Items {
-		if a.AlbumType != "album" {
-			continue
+// RemoveTracks removes every occurrence of uris from a playlist,
+// maxTracksPerRequest at a time.
+func (sp *Spotify) RemoveTracks(playlistId string, uris []string) error {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, uri := range uris {
+		if !seen[uri] {
+			seen[uri] = true
+			unique = append(unique, uri)
 		}
+	}
 
-		names := []string{}
-
-		for _, v := range a.Artists {
-			names = append(names, v.Name)
+	for _, chunk := range chunks(unique) {
+		req := TrackListReq{}
+		for _, uri := range chunk {
+			req.Tracks = append(req.Tracks, TrackUri{uri})
 		}
 
-		opt := SpotifyOption{
-			Name:  fmt.Sprintf("%s - %s", strings.Join(names, " & "), a.Name),
-			Url:   a.ExternalUrls["spotify"],
-			Image: a.Images[0].URL,
+		err := sp.send(http.MethodDelete, sp.apiURL+"/v1/playlists/"+playlistId+"/tracks", req)
+		if err != nil {
+			return fmt.Errorf("deleting the tracks: %w", err)
 		}
-		opts = append(opts, opt)
 	}
-
-	return opts, nil
+	return nil
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/jsol/rootsy-dgraph/spotifyfake"
+)
+
+// countingTransport counts requests by method and path.
+type countingTransport struct {
+	mu    sync.Mutex
+	count map[string]int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	if c.count == nil {
+		c.count = map[string]int{}
+	}
+	c.count[req.Method+" "+req.URL.Path]++
+	c.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (c *countingTransport) get(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.count[key]
+}
+
+func newTestSpotify(t *testing.T, opts ...SpotifyOpt) (*spotifyfake.Server, *Spotify, *countingTransport) {
+	t.Helper()
+
+	srv := spotifyfake.NewServer("id", "secret")
+	t.Cleanup(srv.Close)
+
+	counter := &countingTransport{}
+	opts = append([]SpotifyOpt{WithAccountsURL(srv.URL), WithAPIURL(srv.URL), WithTransport(counter)}, opts...)
+	sp, err := NewSpotify("id", "secret", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, sp, counter
+}
+
+func TestNewSpotifyNeedsCredentials(t *testing.T) {
+	if _, err := NewSpotify("", "secret"); err == nil {
+		t.Error("NewSpotify without an id succeeded")
+	}
+	if _, err := NewSpotify("id", ""); err == nil {
+		t.Error("NewSpotify without a secret succeeded")
+	}
+}
+
+func TestSpotifyToken(t *testing.T) {
+	srv, sp, counter := newTestSpotify(t)
+	srv.AddAlbum(spotifyfake.Album{ID: "a1", Name: "Nebraska", Artists: []string{"Bruce Springsteen"}, Tracks: []string{"t1", "t2"}})
+
+	// Nothing is requested until the client is used.
+	if n := counter.get("POST /api/token"); n != 0 {
+		t.Errorf("token requests before use = %d, want 0", n)
+	}
+
+	if err := sp.Login(); err != nil {
+		t.Fatal(err)
+	}
+	if n := counter.get("POST /api/token"); n != 1 {
+		t.Errorf("token requests = %d, want 1", n)
+	}
+
+	// A valid token is reused.
+	tracks, err := sp.GetAlbumTracks("a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks.Uris) != 2 || tracks.Uris[0] != "spotify:track:t1" {
+		t.Errorf("got %v, want the two tracks of the fake album", tracks.Uris)
+	}
+	if n := counter.get("POST /api/token"); n != 1 {
+		t.Errorf("token requests = %d, want 1", n)
+	}
+}
+
+func TestChunks(t *testing.T) {
+	uris := func(n int) []string {
+		list := []string{}
+		for i := 0; i < n; i++ {
+			list = append(list, fmt.Sprintf("spotify:track:t%03d", i))
+		}
+		return list
+	}
+
+	tests := []struct {
+		n    int
+		want []int
+	}{
+		{0, []int{}},
+		{1, []int{1}},
+		{maxTracksPerRequest, []int{maxTracksPerRequest}},
+		{maxTracksPerRequest + 1, []int{maxTracksPerRequest, 1}},
+		{250, []int{100, 100, 50}},
+	}
+	for _, tt := range tests {
+		list := uris(tt.n)
+		got := []int{}
+		joined := []string{}
+		for _, c := range chunks(list) {
+			got = append(got, len(c))
+			joined = append(joined, c...)
+		}
+		if !slices.Equal(got, tt.want) || !slices.Equal(joined, list) {
+			t.Errorf("chunks of %d = sizes %v, want %v in order", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestSpotifyAlbumTracksPaging(t *testing.T) {
+	srv, sp, counter := newTestSpotify(t)
+
+	tracks := []string{}
+	for i := 0; i < 120; i++ {
+		tracks = append(tracks, fmt.Sprintf("t%03d", i))
+	}
+	srv.AddAlbum(spotifyfake.Album{ID: "box", Name: "The Complete Recordings", Artists: []string{"Robert Johnson"}, Tracks: tracks})
+
+	got, err := sp.GetAlbumTracks("box")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Uris) != 120 || got.Uris[119] != "spotify:track:t119" {
+		t.Errorf("got %d tracks, want 120 in order", len(got.Uris))
+	}
+	if n := counter.get("GET /v1/albums/box/tracks"); n != 3 {
+		t.Errorf("album requests = %d, want 3 pages", n)
+	}
+}
+
+func TestSpotifyPlaylistTracksPaging(t *testing.T) {
+	srv, sp, counter := newTestSpotify(t)
+
+	tracks := []string{}
+	for i := 0; i < 230; i++ {
+		tracks = append(tracks, fmt.Sprintf("spotify:track:t%03d", i))
+	}
+	srv.AddPlaylist("pl", tracks...)
+
+	got, err := sp.PlaylistTracks("pl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, tracks) {
+		t.Errorf("got %d tracks, want %d in order", len(got), len(tracks))
+	}
+	if n := counter.get("GET /v1/playlists/pl/tracks"); n != 3 {
+		t.Errorf("playlist requests = %d, want 3 pages", n)
+	}
+}
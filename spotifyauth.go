@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// spotifyScopes are what the connected user grants: enough to read and
+// change the playlists.
+const spotifyScopes = "playlist-read-private playlist-modify-public playlist-modify-private"
+
+// connectTimeout is how long a started connect waits for its callback.
+const connectTimeout = 10 * time.Minute
+
+var ErrSpotifyNotConnected = errors.New("spotify: no user connected, visit /admin/spotify/connect")
+
+// UserToken is what is kept on disk for the connected user.
+type UserToken struct {
+	RefreshToken string    `json:"refresh_token"`
+	SavedAt      time.Time `json:"saved_at"`
+}
+
+func readUserToken(path string) (UserToken, error) {
+	var t UserToken
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, ErrSpotifyNotConnected
+	}
+	if err != nil {
+		return t, err
+	}
+
+	err = json.Unmarshal(b, &t)
+	if err != nil {
+		return t, fmt.Errorf("%s: %w", path, err)
+	}
+	if t.RefreshToken == "" {
+		return t, ErrSpotifyNotConnected
+	}
+	return t, nil
+}
+
+// writeUserToken replaces the token file in one rename, readable only by
+// the owner.
+func writeUserToken(path string, t UserToken) error {
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".spotify-token-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Chmod(0o600)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// AuthorizeURL is where the user is sent to grant access, with the PKCE
+// challenge of the verifier.
+func (sp *Spotify) AuthorizeURL(state, challenge, redirectURI string) string {
+	v := url.Values{}
+	v.Set("client_id", sp.id)
+	v.Set("response_type", "code")
+	v.Set("redirect_uri", redirectURI)
+	v.Set("scope", spotifyScopes)
+	v.Set("state", state)
+	v.Set("code_challenge_method", "S256")
+	v.Set("code_challenge", challenge)
+
+	return sp.accountsURL + "/authorize?" + v.Encode()
+}
+
+// Connect trades the code from the callback for tokens and stores the
+// refresh token. Requests made after it are made as the user.
+func (sp *Spotify) Connect(code, verifier, redirectURI string) error {
+	if sp.tokenFile == "" {
+		return fmt.Errorf("spotify: client has no user token file")
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("client_id", sp.id)
+	v.Set("code_verifier", verifier)
+
+	sp.refresh = ""
+	err := sp.requestToken(v)
+	if err != nil {
+		return err
+	}
+	if sp.refresh == "" {
+		return fmt.Errorf("spotify: no refresh token in the answer")
+	}
+	return nil
+}
+
+// Connected reports whether a user refresh token is stored.
+func (sp *Spotify) Connected() bool {
+	_, err := readUserToken(sp.tokenFile)
+	return err == nil
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceChallenge is the S256 challenge of a verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type connectAttempt struct {
+	verifier string
+	redirect string
+	expires  time.Time
+}
+
+// spotifyConnects holds the verifiers of started connects by state until
+// the callback comes back.
+type spotifyConnects struct {
+	mu       sync.Mutex
+	attempts map[string]connectAttempt
+}
+
+func newSpotifyConnects() *spotifyConnects {
+	return &spotifyConnects{attempts: map[string]connectAttempt{}}
+}
+
+func (sc *spotifyConnects) add(state string, a connectAttempt) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	now := time.Now()
+	for s, old := range sc.attempts {
+		if now.After(old.expires) {
+			delete(sc.attempts, s)
+		}
+	}
+	sc.attempts[state] = a
+}
+
+// take returns and forgets the attempt of state, so each callback is only
+// used once.
+func (sc *spotifyConnects) take(state string) (connectAttempt, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	a, ok := sc.attempts[state]
+	delete(sc.attempts, state)
+	return a, ok && time.Now().Before(a.expires)
+}
+
+// spotifyRedirect is the callback url registered with Spotify.
+func (app *application) spotifyRedirect() string {
+	if u := os.Getenv("SPOTIFY_REDIRECT_URL"); u != "" {
+		return u
+	}
+	return app.baseURL + "/admin/spotify/callback"
+}
+
+// spotifyConnect starts the authorization code flow with PKCE.
+func (app *application) spotifyConnect(w http.ResponseWriter, r *http.Request) {
+	verifier, err := randomString(64)
+	if err != nil {
+		log.Println("Starting Spotify connect:", err)
+		http.Error(w, "Could not start connecting Spotify", http.StatusInternalServerError)
+		return
+	}
+	state, err := randomString(16)
+	if err != nil {
+		log.Println("Starting Spotify connect:", err)
+		http.Error(w, "Could not start connecting Spotify", http.StatusInternalServerError)
+		return
+	}
+
+	redirect := app.spotifyRedirect()
+	app.connects.add(state, connectAttempt{
+		verifier: verifier,
+		redirect: redirect,
+		expires:  time.Now().Add(connectTimeout),
+	})
+
+	http.Redirect(w, r, app.spUser.AuthorizeURL(state, pkceChallenge(verifier), redirect), http.StatusFound)
+}
+
+// spotifyCallback finishes the flow started by spotifyConnect.
+func (app *application) spotifyCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "Spotify said: "+e, http.StatusBadRequest)
+		return
+	}
+
+	attempt, ok := app.connects.take(q.Get("state"))
+	if !ok {
+		http.Error(w, "Unknown or expired state, connect again", http.StatusBadRequest)
+		return
+	}
+
+	err := app.spUser.Connect(q.Get("code"), attempt.verifier, attempt.redirect)
+	if err != nil {
+		log.Println("Connecting Spotify:", err)
+		http.Error(w, "Could not connect Spotify", http.StatusBadGateway)
+		return
+	}
+
+	log.Println("Spotify user connected")
+	http.Redirect(w, r, "/spotify", http.StatusSeeOther)
+}
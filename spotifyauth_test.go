@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// connectUser runs the authorization code flow against the fake, which
+// approves at once.
+func connectUser(t *testing.T, sp *Spotify) {
+	t.Helper()
+
+	const redirect = "http://rootsy.test/admin/spotify/callback"
+	verifier := "a-verifier-that-is-long-enough-for-pkce-0123456789"
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Get(sp.AuthorizeURL("state", pkceChallenge(verifier), redirect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	back, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sp.Connect(back.Query().Get("code"), verifier, redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpotifyConnectWrongVerifier(t *testing.T) {
+	_, sp, _ := newTestSpotify(t, WithUserToken(filepath.Join(t.TempDir(), "token.json")))
+
+	const redirect = "http://rootsy.test/admin/spotify/callback"
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Get(sp.AuthorizeURL("state", pkceChallenge("the-right-verifier"), redirect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	back, _ := url.Parse(res.Header.Get("Location"))
+
+	err = sp.Connect(back.Query().Get("code"), "the-wrong-verifier", redirect)
+	if err == nil {
+		t.Fatal("Connect with the wrong verifier succeeded")
+	}
+	if sp.Connected() {
+		t.Error("a failed connect stored a token")
+	}
+}
+
+func TestSpotifyPlaylistWritesNeedUser(t *testing.T) {
+	srv, sp, _ := newTestSpotify(t)
+	srv.AddPlaylist("pl")
+
+	err := sp.AddTracks("pl", []string{"spotify:track:a"})
+	var se *SpotifyError
+	if !errors.As(err, &se) || se.Status != http.StatusForbidden {
+		t.Errorf("AddTracks with an app token = %v, want 403", err)
+	}
+}
+
+func TestSpotifyAddRemoveBatches(t *testing.T) {
+	srv, sp, counter := newTestSpotify(t, WithUserToken(filepath.Join(t.TempDir(), "token.json")))
+	connectUser(t, sp)
+	srv.AddPlaylist("pl")
+
+	uris := []string{}
+	for i := 0; i < 250; i++ {
+		uris = append(uris, fmt.Sprintf("spotify:track:t%03d", i))
+	}
+
+	err := sp.AddTracks("pl", uris)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := counter.get("POST /v1/playlists/pl/tracks"); n != 3 {
+		t.Errorf("add requests = %d, want 3", n)
+	}
+	if got := srv.PlaylistTracks("pl"); len(got) != 250 || got[249] != uris[249] {
+		t.Errorf("playlist has %d tracks, want 250 in order", len(got))
+	}
+
+	// Duplicates are removed once, so 201 uris are 101 unique ones.
+	remove := append(append([]string{}, uris[:101]...), uris[:100]...)
+	err = sp.RemoveTracks("pl", remove)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := counter.get("DELETE /v1/playlists/pl/tracks"); n != 2 {
+		t.Errorf("remove requests = %d, want 2", n)
+	}
+	if got := srv.PlaylistTracks("pl"); len(got) != 149 || got[0] != uris[101] {
+		t.Errorf("playlist has %d tracks after removing, want 149", len(got))
+	}
+}
+
+func TestSpotifyUserTokenRefresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	srv, sp, counter := newTestSpotify(t, WithUserToken(path))
+	srv.AddPlaylist("pl")
+
+	_, err := sp.PlaylistTracks("pl")
+	if !errors.Is(err, ErrSpotifyNotConnected) {
+		t.Fatalf("err = %v, want ErrSpotifyNotConnected", err)
+	}
+
+	connectUser(t, sp)
+	first, err := readUserToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.ExpireTokens()
+	err = sp.AddTracks("pl", []string{"spotify:track:a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := readUserToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Error("the rotated refresh token was not saved")
+	}
+	if n := counter.get("POST /api/token"); n != 2 {
+		t.Errorf("token requests = %d, want 2", n)
+	}
+}
+
+func TestSpotifyConnects(t *testing.T) {
+	sc := newSpotifyConnects()
+	sc.add("fresh", connectAttempt{verifier: "v1", expires: time.Now().Add(time.Minute)})
+	sc.add("stale", connectAttempt{verifier: "v2", expires: time.Now().Add(-time.Second)})
+
+	tests := []struct {
+		name, state string
+		ok          bool
+	}{
+		{"started connect", "fresh", true},
+		{"state used twice", "fresh", false},
+		{"expired attempt", "stale", false},
+		{"unknown state", "other", false},
+	}
+	for _, tt := range tests {
+		a, ok := sc.take(tt.state)
+		if ok != tt.ok {
+			t.Errorf("%s: take(%q) ok = %v, want %v", tt.name, tt.state, ok, tt.ok)
+		}
+		if ok && a.verifier != "v1" {
+			t.Errorf("%s: verifier = %q, want v1", tt.name, a.verifier)
+		}
+	}
+
+	// Expired attempts are dropped when a new one starts.
+	sc.add("stale", connectAttempt{expires: time.Now().Add(-time.Second)})
+	sc.add("new", connectAttempt{expires: time.Now().Add(time.Minute)})
+	if _, ok := sc.attempts["stale"]; ok {
+		t.Error("expired attempt kept")
+	}
+}
+
+func TestWriteUserToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	if err := os.WriteFile(path, []byte(`{"refresh_token":"old"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := writeUserToken(path, UserToken{RefreshToken: "new", SavedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("token file mode = %o, want 600", perm)
+	}
+	got, err := readUserToken(path)
+	if err != nil || got.RefreshToken != "new" {
+		t.Errorf("readUserToken = %+v, %v, want the new token", got, err)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files next to the token, want no temporary files left", len(entries))
+	}
+}
+
+func TestSpotifyConnectCallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	_, sp, _ := newTestSpotify(t, WithUserToken(path))
+	app := &application{spUser: sp, connects: newSpotifyConnects(), baseURL: "http://rootsy.test"}
+
+	rec := httptest.NewRecorder()
+	app.spotifyConnect(rec, httptest.NewRequest(http.MethodGet, "/admin/spotify/connect", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("connect status = %d, want 302", rec.Code)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	back, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := back.Scheme + "://" + back.Host + back.Path; got != app.spotifyRedirect() {
+		t.Fatalf("redirected to %s, want %s", got, app.spotifyRedirect())
+	}
+
+	callback := "/admin/spotify/callback?" + back.RawQuery
+	rec = httptest.NewRecorder()
+	app.spotifyCallback(rec, httptest.NewRequest(http.MethodGet, callback, nil))
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("callback status = %d, want 303: %s", rec.Code, rec.Body)
+	}
+	if !sp.Connected() {
+		t.Error("no token stored after the callback")
+	}
+
+	// The same callback again is refused.
+	rec = httptest.NewRecorder()
+	app.spotifyCallback(rec, httptest.NewRequest(http.MethodGet, callback, nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("second callback status = %d, want 400", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	app.spotifyCallback(rec, httptest.NewRequest(http.MethodGet, "/admin/spotify/callback?error=access_denied&state=x", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("denied callback status = %d, want 400", rec.Code)
+	}
+}
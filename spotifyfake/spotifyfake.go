@@ -0,0 +1,603 @@
+// Package spotifyfake is an in-memory stand-in for the parts of the
+// Spotify accounts service and Web API that rootsy uses: client
+// credentials and user tokens, album search, album tracks and playlist
+// tracks. Responses are paged with next links like the real API. The
+// authorize page approves every request at once, and like Spotify only
+// user tokens may change playlists.
+package spotifyfake
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxTracksPerRequest is the most tracks Spotify accepts in one add or
+// remove call.
+const MaxTracksPerRequest = 100
+
+type Image struct {
+	URL    string `json:"url"`
+	Height int    `json:"height"`
+	Width  int    `json:"width"`
+}
+
+type Album struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Artists     []string `json:"artists"`
+	AlbumType   string   `json:"album_type"`
+	ReleaseDate string   `json:"release_date"`
+	Markets     []string `json:"markets"`
+	Images      []Image  `json:"images"`
+	// Tracks are track ids; their uris are spotify:track:<id>.
+	Tracks []string `json:"tracks"`
+}
+
+// Seed is the JSON a fake can be loaded from.
+type Seed struct {
+	Albums    []Album             `json:"albums"`
+	Playlists map[string][]string `json:"playlists"`
+}
+
+// Load adds the albums and playlists of a Seed.
+func (f *Fake) Load(seed Seed) {
+	for _, a := range seed.Albums {
+		f.AddAlbum(a)
+	}
+	for id, tracks := range seed.Playlists {
+		f.AddPlaylist(id, tracks...)
+	}
+}
+
+// Fake holds the state behind the handler. Lock Mu when changing it while
+// the server runs.
+type Fake struct {
+	Mu sync.Mutex
+
+	ClientID     string
+	ClientSecret string
+	TokenTTL     time.Duration
+
+	Albums    map[string]*Album
+	Playlists map[string][]string
+
+	tokens      map[string]token
+	refresh     map[string]bool
+	codes       map[string]authCode
+	rateLimited int
+	retryAfter  int
+	base        string
+}
+
+func New(clientID, clientSecret string) *Fake {
+	return &Fake{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenTTL:     time.Hour,
+		Albums:       map[string]*Album{},
+		Playlists:    map[string][]string{},
+		tokens:       map[string]token{},
+		refresh:      map[string]bool{},
+		codes:        map[string]authCode{},
+	}
+}
+
+type token struct {
+	expires time.Time
+	// user is set for tokens from the authorization code flow.
+	user bool
+}
+
+type authCode struct {
+	challenge string
+	redirect  string
+}
+
+// Server runs the fake on a local httptest server.
+type Server struct {
+	*Fake
+	*httptest.Server
+}
+
+// NewServer starts a fake. Point the client at srv.URL for both the
+// accounts service and the Web API.
+func NewServer(clientID, clientSecret string) *Server {
+	f := New(clientID, clientSecret)
+	srv := httptest.NewServer(f)
+	f.SetBaseURL(srv.URL)
+	return &Server{f, srv}
+}
+
+// SetBaseURL is what next links and external urls start with.
+func (f *Fake) SetBaseURL(u string) {
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	f.base = strings.TrimSuffix(u, "/")
+}
+
+func (f *Fake) AddAlbum(a Album) {
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	if a.AlbumType == "" {
+		a.AlbumType = "album"
+	}
+	f.Albums[a.ID] = &a
+}
+
+func (f *Fake) AddPlaylist(id string, tracks ...string) {
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	f.Playlists[id] = append([]string{}, tracks...)
+}
+
+// PlaylistTracks returns a copy of the track uris of a playlist.
+func (f *Fake) PlaylistTracks(id string) []string {
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	return append([]string{}, f.Playlists[id]...)
+}
+
+// ExpireTokens makes every issued token answer 401.
+func (f *Fake) ExpireTokens() {
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	for t, tok := range f.tokens {
+		tok.expires = time.Time{}
+		f.tokens[t] = tok
+	}
+}
+
+// RateLimit answers the next n API requests with 429 and Retry-After.
+func (f *Fake) RateLimit(n, retryAfter int) {
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	f.rateLimited = n
+	f.retryAfter = retryAfter
+}
+
+func (f *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/token":
+		f.token(w, r)
+		return
+	case "/authorize":
+		f.authorize(w, r)
+		return
+	}
+
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+
+	tok, ok := f.authorized(r)
+	if !ok {
+		apiError(w, http.StatusUnauthorized, "The access token expired")
+		return
+	}
+	if f.rateLimited > 0 {
+		f.rateLimited--
+		w.Header().Set("Retry-After", strconv.Itoa(f.retryAfter))
+		apiError(w, http.StatusTooManyRequests, "API rate limit exceeded")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "v1" && parts[1] == "search" && r.Method == http.MethodGet:
+		f.search(w, r)
+	case len(parts) == 4 && parts[0] == "v1" && parts[1] == "albums" && parts[3] == "tracks" && r.Method == http.MethodGet:
+		f.albumTracks(w, r, parts[2])
+	case len(parts) == 4 && parts[0] == "v1" && parts[1] == "playlists" && parts[3] == "tracks":
+		if r.Method != http.MethodGet && !tok.user {
+			apiError(w, http.StatusForbidden, "This request requires user authentication.")
+			return
+		}
+		f.playlistTracks(w, r, parts[2])
+	default:
+		apiError(w, http.StatusNotFound, "Service not found")
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{"status": status, "message": message},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// authorize approves at once and sends the browser back with a code.
+func (f *Fake) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "Illegal redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+
+	if q.Get("client_id") != f.ClientID {
+		http.Error(w, "Invalid client", http.StatusBadRequest)
+		return
+	}
+
+	back := redirect.Query()
+	back.Set("state", q.Get("state"))
+	if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		back.Set("error", "invalid_request")
+	} else {
+		code := newToken()
+		f.codes[code] = authCode{challenge: q.Get("code_challenge"), redirect: q.Get("redirect_uri")}
+		back.Set("code", code)
+	}
+	redirect.RawQuery = back.Encode()
+
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func tokenError(w http.ResponseWriter, e, description string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": e, "error_description": description})
+}
+
+func (f *Fake) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+
+	grant := r.PostFormValue("grant_type")
+
+	// The user grants are PKCE flows, which need no secret.
+	if id != f.ClientID || (grant == "client_credentials" || secret != "") && secret != f.ClientSecret {
+		tokenError(w, "invalid_client", "Invalid client")
+		return
+	}
+
+	switch grant {
+	case "client_credentials":
+		f.issue(w, false)
+
+	case "authorization_code":
+		code, ok := f.codes[r.PostFormValue("code")]
+		delete(f.codes, r.PostFormValue("code"))
+		if !ok {
+			tokenError(w, "invalid_grant", "Invalid authorization code")
+			return
+		}
+		if code.redirect != r.PostFormValue("redirect_uri") {
+			tokenError(w, "invalid_grant", "Invalid redirect URI")
+			return
+		}
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+			tokenError(w, "invalid_grant", "code_verifier was incorrect")
+			return
+		}
+		f.issue(w, true)
+
+	case "refresh_token":
+		if !f.refresh[r.PostFormValue("refresh_token")] {
+			tokenError(w, "invalid_grant", "Refresh token revoked")
+			return
+		}
+		// Refresh tokens are used once, like Spotify does for PKCE.
+		delete(f.refresh, r.PostFormValue("refresh_token"))
+		f.issue(w, true)
+
+	default:
+		tokenError(w, "unsupported_grant_type", "grant_type must be client_credentials, authorization_code or refresh_token")
+	}
+}
+
+// issue answers with a new access token, and a refresh token for users.
+func (f *Fake) issue(w http.ResponseWriter, user bool) {
+	t := newToken()
+	f.tokens[t] = token{expires: time.Now().Add(f.TokenTTL), user: user}
+
+	res := map[string]any{
+		"access_token": t,
+		"token_type":   "Bearer",
+		"expires_in":   int(f.TokenTTL.Seconds()),
+	}
+	if user {
+		refresh := newToken()
+		f.refresh[refresh] = true
+		res["refresh_token"] = refresh
+		res["scope"] = "playlist-read-private playlist-modify-public playlist-modify-private"
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (f *Fake) authorized(r *http.Request) (token, bool) {
+	t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return token{}, false
+	}
+	tok, ok := f.tokens[t]
+	return tok, ok && time.Now().Before(tok.expires)
+}
+
+// page reads limit and offset like Spotify, with its defaults and caps.
+func page(r *http.Request, def, max int) (int, int) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = def
+	}
+	if limit > max {
+		limit = max
+	}
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// paging builds the paging object around items[offset:offset+limit].
+func (f *Fake) paging(r *http.Request, items []any, limit, offset int) map[string]any {
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	pageItems := []any{}
+	if offset < len(items) {
+		pageItems = items[offset:end]
+	}
+
+	link := func(offset int) any {
+		q := r.URL.Query()
+		q.Set("offset", strconv.Itoa(offset))
+		q.Set("limit", strconv.Itoa(limit))
+		return f.base + r.URL.Path + "?" + q.Encode()
+	}
+
+	p := map[string]any{
+		"href":     link(offset),
+		"items":    pageItems,
+		"limit":    limit,
+		"offset":   offset,
+		"total":    len(items),
+		"next":     nil,
+		"previous": nil,
+	}
+	if end < len(items) {
+		p["next"] = link(end)
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		p["previous"] = link(prev)
+	}
+	return p
+}
+
+func (f *Fake) albumJSON(a *Album) map[string]any {
+	artists := []any{}
+	for _, name := range a.Artists {
+		id := strings.ToLower(strings.ReplaceAll(name, " ", ""))
+		artists = append(artists, map[string]any{
+			"id":            id,
+			"name":          name,
+			"type":          "artist",
+			"uri":           "spotify:artist:" + id,
+			"href":          f.base + "/v1/artists/" + id,
+			"external_urls": map[string]string{"spotify": "https://open.spotify.com/artist/" + id},
+		})
+	}
+	images := a.Images
+	if images == nil {
+		images = []Image{}
+	}
+	return map[string]any{
+		"id":                     a.ID,
+		"name":                   a.Name,
+		"album_type":             a.AlbumType,
+		"artists":                artists,
+		"images":                 images,
+		"release_date":           a.ReleaseDate,
+		"release_date_precision": "day",
+		"total_tracks":           len(a.Tracks),
+		"type":                   "album",
+		"uri":                    "spotify:album:" + a.ID,
+		"href":                   f.base + "/v1/albums/" + a.ID,
+		"external_urls":          map[string]string{"spotify": "https://open.spotify.com/album/" + a.ID},
+	}
+}
+
+// matches understands plain words and the artist: and album: filters.
+// Words after a filter belong to it, every word must be found.
+func matches(a *Album, query string) bool {
+	artists := strings.ToLower(strings.Join(a.Artists, " "))
+	name := strings.ToLower(a.Name)
+
+	field := ""
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		for _, prefix := range []string{"artist:", "album:"} {
+			if rest, ok := strings.CutPrefix(word, prefix); ok {
+				field, word = prefix, rest
+			}
+		}
+		word = strings.Trim(word, `"`)
+		if word == "" {
+			continue
+		}
+
+		switch field {
+		case "artist:":
+			if !strings.Contains(artists, word) {
+				return false
+			}
+		case "album:":
+			if !strings.Contains(name, word) {
+				return false
+			}
+		default:
+			if !strings.Contains(name, word) && !strings.Contains(artists, word) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (f *Fake) search(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("q") == "" {
+		apiError(w, http.StatusBadRequest, "No search query")
+		return
+	}
+	if !strings.Contains(q.Get("type"), "album") {
+		apiError(w, http.StatusBadRequest, "Only album search is faked")
+		return
+	}
+	market := q.Get("market")
+
+	ids := make([]string, 0, len(f.Albums))
+	for id := range f.Albums {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	items := []any{}
+	for _, id := range ids {
+		a := f.Albums[id]
+		if market != "" && len(a.Markets) > 0 && !contains(a.Markets, market) {
+			continue
+		}
+		if matches(a, q.Get("q")) {
+			items = append(items, f.albumJSON(a))
+		}
+	}
+
+	limit, offset := page(r, 20, 50)
+	writeJSON(w, http.StatusOK, map[string]any{"albums": f.paging(r, items, limit, offset)})
+}
+
+func (f *Fake) albumTracks(w http.ResponseWriter, r *http.Request, id string) {
+	a, ok := f.Albums[id]
+	if !ok {
+		apiError(w, http.StatusNotFound, "Non existing id")
+		return
+	}
+
+	items := []any{}
+	for i, t := range a.Tracks {
+		items = append(items, map[string]any{
+			"id":           t,
+			"name":         fmt.Sprintf("%s %d", a.Name, i+1),
+			"track_number": i + 1,
+			"uri":          "spotify:track:" + t,
+		})
+	}
+
+	limit, offset := page(r, 20, 50)
+	writeJSON(w, http.StatusOK, f.paging(r, items, limit, offset))
+}
+
+type trackList struct {
+	Uris   []string `json:"uris"`
+	Tracks []struct {
+		Uri string `json:"uri"`
+	} `json:"tracks"`
+}
+
+func (f *Fake) playlistTracks(w http.ResponseWriter, r *http.Request, id string) {
+	tracks, ok := f.Playlists[id]
+	if !ok {
+		apiError(w, http.StatusNotFound, "Invalid playlist Id")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		items := []any{}
+		for _, uri := range tracks {
+			items = append(items, map[string]any{"track": map[string]any{"uri": uri}})
+		}
+		limit, offset := page(r, 100, 100)
+		writeJSON(w, http.StatusOK, f.paging(r, items, limit, offset))
+
+	case http.MethodPost:
+		var body trackList
+		if json.NewDecoder(r.Body).Decode(&body) != nil {
+			apiError(w, http.StatusBadRequest, "Error parsing JSON")
+			return
+		}
+		if len(body.Uris) > MaxTracksPerRequest {
+			apiError(w, http.StatusBadRequest, "Too many ids requested")
+			return
+		}
+		f.Playlists[id] = append(tracks, body.Uris...)
+		writeJSON(w, http.StatusCreated, map[string]string{"snapshot_id": newToken()})
+
+	case http.MethodDelete:
+		var body trackList
+		if json.NewDecoder(r.Body).Decode(&body) != nil {
+			apiError(w, http.StatusBadRequest, "Error parsing JSON")
+			return
+		}
+		if len(body.Tracks) > MaxTracksPerRequest {
+			apiError(w, http.StatusBadRequest, "Too many ids requested")
+			return
+		}
+		remove := map[string]bool{}
+		for _, t := range body.Tracks {
+			remove[t.Uri] = true
+		}
+		kept := []string{}
+		for _, uri := range tracks {
+			if !remove[uri] {
+				kept = append(kept, uri)
+			}
+		}
+		f.Playlists[id] = kept
+		writeJSON(w, http.StatusOK, map[string]string{"snapshot_id": newToken()})
+
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
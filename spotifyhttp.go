@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	spotifyTimeout = 30 * time.Second
+	// maxRetryAfter caps how long a request waits on a 429 before giving
+	// up, so an admin page does not hang for minutes.
+	maxRetryAfter    = 10 * time.Second
+	rateLimitRetries = 2
+	// tokenMargin refreshes tokens a little before they expire.
+	tokenMargin = 30 * time.Second
+)
+
+var (
+	ErrSpotifyUnauthorized = errors.New("spotify: unauthorized")
+	ErrSpotifyRateLimited  = errors.New("spotify: rate limited")
+	ErrSpotifyNotFound     = errors.New("spotify: not found")
+)
+
+// SpotifyError is a non-2xx response from Spotify. It matches
+// ErrSpotifyUnauthorized, ErrSpotifyRateLimited and ErrSpotifyNotFound
+// with errors.Is.
+type SpotifyError struct {
+	Status     int
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *SpotifyError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("spotify: %d %s", e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("spotify: %d %s", e.Status, e.Message)
+}
+
+func (e *SpotifyError) Is(target error) bool {
+	switch target {
+	case ErrSpotifyUnauthorized:
+		return e.Status == http.StatusUnauthorized
+	case ErrSpotifyRateLimited:
+		return e.Status == http.StatusTooManyRequests
+	case ErrSpotifyNotFound:
+		return e.Status == http.StatusNotFound
+	}
+	return false
+}
+
+// spotifyError reads the error from res. The Web API answers with
+// {"error": {"status", "message"}}, the accounts service with
+// {"error", "error_description"}.
+func spotifyError(res *http.Response, body []byte) error {
+	e := &SpotifyError{
+		Status:     res.StatusCode,
+		RetryAfter: retryAfter(res),
+	}
+
+	var api struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	var accounts struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if json.Unmarshal(body, &api) == nil && api.Error.Message != "" {
+		e.Message = api.Error.Message
+	} else if json.Unmarshal(body, &accounts) == nil && accounts.Error != "" {
+		e.Message = accounts.Error
+		if accounts.Description != "" {
+			e.Message += ": " + accounts.Description
+		}
+	}
+
+	return e
+}
+
+func retryAfter(res *http.Response) time.Duration {
+	s, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil || s < 0 {
+		return time.Second
+	}
+	return time.Duration(s) * time.Second
+}
+
+// readResponse returns the body of a 2xx response and a SpotifyError for
+// anything else.
+func readResponse(res *http.Response) ([]byte, error) {
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, spotifyError(res, body)
+	}
+	return body, nil
+}
+
+// spotifyTransport authenticates requests to the Web API. It refreshes
+// the token before it expires, refreshes and retries once on 401, and
+// waits out Retry-After on 429.
+type spotifyTransport struct {
+	sp   *Spotify
+	base http.RoundTripper
+}
+
+func (t *spotifyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+
+	token, err := t.sp.accessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.try(req, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized {
+		res.Body.Close()
+		token, err = t.sp.refreshToken(token)
+		if err != nil {
+			return nil, err
+		}
+		res, err = t.try(req, token)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 0; i < rateLimitRetries && res.StatusCode == http.StatusTooManyRequests; i++ {
+		wait := retryAfter(res)
+		if wait > maxRetryAfter {
+			break
+		}
+		res.Body.Close()
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		res, err = t.try(req, token)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// try sends a copy of req with token, rewinding the body for retries.
+func (t *spotifyTransport) try(req *http.Request, token string) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	return t.base.RoundTrip(r)
+}
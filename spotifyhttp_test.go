@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/jsol/rootsy-dgraph/spotifyfake"
+)
+
+func TestSpotifyBadClient(t *testing.T) {
+	srv := spotifyfake.NewServer("id", "secret")
+	defer srv.Close()
+
+	sp, err := NewSpotify("id", "wrong", WithAccountsURL(srv.URL), WithAPIURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sp.Login()
+	var se *SpotifyError
+	if !errors.As(err, &se) || se.Status != http.StatusBadRequest {
+		t.Fatalf("Login = %v, want a 400 SpotifyError", err)
+	}
+}
+
+func TestSpotifyNotFound(t *testing.T) {
+	_, sp, _ := newTestSpotify(t)
+
+	_, err := sp.GetAlbumTracks("missing")
+	if !errors.Is(err, ErrSpotifyNotFound) {
+		t.Errorf("err = %v, want ErrSpotifyNotFound", err)
+	}
+}
+
+func TestSpotifyRetryUnauthorized(t *testing.T) {
+	srv, sp, counter := newTestSpotify(t)
+	srv.AddAlbum(spotifyfake.Album{ID: "a1", Name: "Nebraska", Artists: []string{"Bruce Springsteen"}, Tracks: []string{"t1"}})
+
+	if _, err := sp.GetAlbumTracks("a1"); err != nil {
+		t.Fatal(err)
+	}
+	srv.ExpireTokens()
+
+	tracks, err := sp.GetAlbumTracks("a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks.Uris) != 1 {
+		t.Errorf("got %d tracks after refresh, want 1", len(tracks.Uris))
+	}
+	if n := counter.get("POST /api/token"); n != 2 {
+		t.Errorf("token requests = %d, want 2", n)
+	}
+	if n := counter.get("GET /v1/albums/a1/tracks"); n != 3 {
+		t.Errorf("album requests = %d, want 3 with the retry", n)
+	}
+}
+
+func TestSpotifyRetryRateLimited(t *testing.T) {
+	srv, sp, counter := newTestSpotify(t)
+	srv.AddAlbum(spotifyfake.Album{ID: "a1", Name: "Nebraska", Artists: []string{"Bruce Springsteen"}, Tracks: []string{"t1"}})
+
+	srv.RateLimit(rateLimitRetries, 0)
+	tracks, err := sp.GetAlbumTracks("a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks.Uris) != 1 {
+		t.Errorf("got %d tracks, want 1", len(tracks.Uris))
+	}
+	if n := counter.get("GET /v1/albums/a1/tracks"); n != rateLimitRetries+1 {
+		t.Errorf("album requests = %d, want %d", n, rateLimitRetries+1)
+	}
+
+	srv.RateLimit(rateLimitRetries+1, 0)
+	_, err = sp.GetAlbumTracks("a1")
+	if !errors.Is(err, ErrSpotifyRateLimited) {
+		t.Errorf("err = %v, want ErrSpotifyRateLimited", err)
+	}
+
+	// A wait above maxRetryAfter is not waited out.
+	srv.RateLimit(1, int(2*maxRetryAfter.Seconds()))
+	_, err = sp.GetAlbumTracks("a1")
+	var se *SpotifyError
+	if !errors.As(err, &se) || se.RetryAfter != 2*maxRetryAfter {
+		t.Errorf("err = %v, want a 429 with the Retry-After", err)
+	}
+}
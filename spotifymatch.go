@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+const (
+	matchPageSize = 100
+	// matchMargin is how far ahead of the best different album the best
+	// candidate must be to be applied without a human looking at it.
+	matchMargin = 0.1
+	// matchUser is who the job's decisions are recorded as.
+	matchUser = "spotify-match"
+)
+
+// editionSuffix matches "(Deluxe Edition)", "[2015 Remaster]" and
+// " - Remastered" style additions to album names.
+var editionSuffix = regexp.MustCompile(`(?i)\s*[(\[][^)\]]*\b(deluxe|remaster(ed)?|edition|expanded|anniversary|bonus|version|mono|stereo|reissue)\b[^)\]]*[)\]]|\s+-\s+[^-]*\b(deluxe|remaster(ed)?|edition|version)\b.*$`)
+
+// normalizeName folds case and diacritics, drops edition notes, a leading
+// "the" and punctuation, so "The Band (Remastered)" equals "band".
+func normalizeName(s string) string {
+	s = editionSuffix.ReplaceAllString(s, "")
+	s = strings.ReplaceAll(foldText(s), "&", " and ")
+
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune(' ')
+		}
+	}
+	s = strings.Join(strings.Fields(b.String()), " ")
+	return strings.TrimPrefix(s, "the ")
+}
+
+// nameSimilarity is one minus the edit distance of the normalized names
+// over the length of the longer one.
+func nameSimilarity(a, b string) float64 {
+	ra, rb := []rune(normalizeName(a)), []rune(normalizeName(b))
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return 1 - float64(prev[len(rb)])/float64(max(len(ra), len(rb)))
+}
+
+func variousArtists(name string) bool {
+	return strings.HasPrefix(name, "Blandade") || strings.HasPrefix(name, "Various")
+}
+
+// searchArtist is the artist name as Spotify writes it.
+func searchArtist(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, ", The"), ", the")
+}
+
+// matchSubject is what a candidate is compared with. Year is when the
+// content was published; reviews come out close to the record.
+type matchSubject struct {
+	Album  string
+	Artist string
+	Year   int
+}
+
+func subjectOf(c DGraphContent) matchSubject {
+	s := matchSubject{Album: c.Name, Artist: "No artist"}
+	if len(c.Artist) > 0 {
+		s.Artist = searchArtist(c.Artist[0].Name)
+	}
+	if len(c.PublishedAt) >= 4 {
+		s.Year, _ = strconv.Atoi(c.PublishedAt[:4])
+	}
+	return s
+}
+
+func yearScore(subject, release int) float64 {
+	if subject == 0 || release == 0 {
+		return 0.5
+	}
+	switch d := subject - release; {
+	case d >= 0 && d <= 1:
+		return 1
+	case d >= 2 && d <= 5:
+		return 0.5
+	default:
+		// Much older, or released after the review: a reissue.
+		return 0.2
+	}
+}
+
+// trackScore only checks that the record looks like an album, rootsy does
+// not store track counts.
+func trackScore(tracks int) float64 {
+	switch {
+	case tracks == 0:
+		return 0.5
+	case tracks >= 6 && tracks <= 25:
+		return 1
+	case tracks >= 3 && tracks <= 40:
+		return 0.6
+	default:
+		return 0.3
+	}
+}
+
+func scoreOption(s matchSubject, o SpotifyOption) float64 {
+	album := nameSimilarity(s.Album, o.Album)
+
+	artist := 0.0
+	if variousArtists(s.Artist) {
+		artist = 0.5
+		for _, a := range o.Artists {
+			if variousArtists(a) {
+				artist = 1
+			}
+		}
+	} else {
+		artist = nameSimilarity(s.Artist, strings.Join(o.Artists, " & "))
+		for _, a := range o.Artists {
+			artist = max(artist, nameSimilarity(s.Artist, a))
+		}
+	}
+
+	return 0.5*album + 0.3*artist + 0.1*yearScore(s.Year, o.Year) + 0.1*trackScore(o.Tracks)
+}
+
+// scoreOptions sets Score on the options and sorts them best first.
+func scoreOptions(s matchSubject, opts []SpotifyOption) []SpotifyOption {
+	for i := range opts {
+		opts[i].Score = scoreOption(s, opts[i])
+	}
+	sort.SliceStable(opts, func(i, j int) bool {
+		return opts[i].Score > opts[j].Score
+	})
+	return opts
+}
+
+// confidentMatch returns the best option if it reaches threshold and no
+// other album comes close. Other editions of the same album do not make a
+// match ambiguous.
+func confidentMatch(scored []SpotifyOption, threshold float64) (SpotifyOption, bool) {
+	if len(scored) == 0 || scored[0].Score < threshold {
+		return SpotifyOption{}, false
+	}
+
+	best := scored[0]
+	key := normalizeName(best.Album) + "|" + normalizeName(strings.Join(best.Artists, " "))
+	for _, o := range scored[1:] {
+		if normalizeName(o.Album)+"|"+normalizeName(strings.Join(o.Artists, " ")) == key {
+			continue
+		}
+		// A lead of exactly matchMargin is enough, even when the
+		// subtraction rounds below it.
+		if best.Score-o.Score < matchMargin-1e-9 {
+			return SpotifyOption{}, false
+		}
+		break
+	}
+	return best, true
+}
+
+// Percent is the score for the admin page.
+func (o SpotifyOption) Percent() int {
+	return int(o.Score*100 + 0.5)
+}
+
+// matchSpotify searches Spotify for all pending content, the old "x"
+// sentinel included, and links the confident matches. Content with
+// candidates that are not clear enough moves to needs-review, content
+// without any stays pending.
+func (app *application) matchSpotify(ctx context.Context) error {
+	dc := api.NewDgraphClient(app.conn)
+	dg := dgo.NewDgraphClient(dc)
+
+	threshold := float64(envInt("SPOTIFY_MATCH_THRESHOLD", 85)) / 100
+
+	vars, fn := spotifyStateVar("p", spotifyPending)
+	q := `query Pending($after: string, $first: int) {
+		` + vars + `
+		content(func: ` + fn + `, first: $first, after: $after) @filter(type(Content) AND NOT eq(type, "article")) {
+			uid
+			oldId
+			name: album
+			published_at
+			artist {
+				name
+			}
+		}
+	}`
+
+	matched, review, left, failed := 0, 0, 0, 0
+	after := "0x0"
+	for {
+		txn := dg.NewReadOnlyTxn()
+		res, err := txn.QueryWithVars(ctx, q, map[string]string{"$after": after, "$first": fmt.Sprint(matchPageSize)})
+		txn.Discard(ctx)
+		if err != nil {
+			return err
+		}
+
+		var resp ContentResponse
+		err = json.Unmarshal(res.Json, &resp)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range resp.Content {
+			s := subjectOf(c)
+			opts, err := app.sp.Search(s.Artist, s.Album, SearchFilter{Market: app.spotifyMarket})
+			if errors.Is(err, ErrSpotifyUnauthorized) {
+				return err
+			}
+			if err != nil {
+				log.Printf("Searching Spotify for %s: %v", c.Uid, err)
+				failed++
+				continue
+			}
+
+			if len(opts) == 0 {
+				left++
+				continue
+			}
+
+			best, ok := confidentMatch(scoreOptions(s, opts), threshold)
+			if !ok {
+				err = setSpotifyState(ctx, dg, c.Uid, spotifyNeedsReview, "", matchUser)
+				if err != nil {
+					return err
+				}
+				review++
+				continue
+			}
+
+			log.Printf("Linking %s - %s to %s (%d%%)", s.Artist, s.Album, best.Url, best.Percent())
+			err = setSpotifyState(ctx, dg, c.Uid, spotifyLinked, best.Url, matchUser)
+			if err != nil {
+				return err
+			}
+			saveSpotify(c.Id, best.Url, spotifyLinked)
+			matched++
+		}
+
+		if len(resp.Content) < matchPageSize {
+			break
+		}
+		after = resp.Content[len(resp.Content)-1].Uid
+	}
+
+	log.Printf("Spotify matching: %d linked, %d need review, %d without candidates, %d failed", matched, review, left, failed)
+	return nil
+}
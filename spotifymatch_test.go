@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"Nebraska", "nebraska"},
+		{"The Band (Remastered)", "band"},
+		{"Bob Dylan [Deluxe Edition]", "bob dylan"},
+		{"Sånger från en stad - 2015 Remaster", "sanger fran en stad"},
+		{"Åsa & Öberg", "asa and oberg"},
+		{"AC/DC", "ac dc"},
+		{"  Hello,   World! ", "hello world"},
+		// Only a leading "the " goes, not the whole name.
+		{"The", "the"},
+		{"Other Side", "other side"},
+	}
+	for _, tt := range tests {
+		if got := normalizeName(tt.name); got != tt.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNameSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"Nebraska", "Nebraska", 1},
+		{"Nebraska", "Nebraska (Deluxe Edition)", 1},
+		{"The Band", "band", 1},
+		{"Springsteen", "Springstein", 1 - 1.0/11},
+		{"abc", "xyz", 0},
+		{"", "", 1},
+		{"abcd", "", 0},
+	}
+	for _, tt := range tests {
+		if got := nameSimilarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("nameSimilarity(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := nameSimilarity(tt.b, tt.a); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("nameSimilarity(%q, %q) = %v, want %v", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestConfidentMatch(t *testing.T) {
+	option := func(album, artist string, score float64) SpotifyOption {
+		return SpotifyOption{Album: album, Artists: []string{artist}, Score: score, Url: album + "/" + artist}
+	}
+
+	tests := []struct {
+		name   string
+		scored []SpotifyOption
+		want   string
+	}{
+		{"nothing found", nil, ""},
+		{"single option", []SpotifyOption{option("Nebraska", "Bruce Springsteen", 0.9)}, "Nebraska/Bruce Springsteen"},
+		{"below threshold", []SpotifyOption{option("Nebraska", "Bruce Springsteen", 0.7)}, ""},
+		{"clear lead", []SpotifyOption{
+			option("Nebraska", "Bruce Springsteen", 0.95),
+			option("Tunnel of Love", "Bruce Springsteen", 0.6),
+		}, "Nebraska/Bruce Springsteen"},
+		{"lead of exactly the margin", []SpotifyOption{
+			option("Nebraska", "Bruce Springsteen", 0.9),
+			option("Nebraska", "Dave Alvin", 0.8),
+		}, "Nebraska/Bruce Springsteen"},
+		{"near tie just inside the margin", []SpotifyOption{
+			option("Nebraska", "Bruce Springsteen", 0.9),
+			option("Nebraska", "Dave Alvin", 0.8001),
+		}, ""},
+		{"editions do not count", []SpotifyOption{
+			option("Nebraska", "Bruce Springsteen", 0.9),
+			option("Nebraska (Deluxe Edition)", "Bruce Springsteen", 0.89),
+			option("Tunnel of Love", "Bruce Springsteen", 0.5),
+		}, "Nebraska/Bruce Springsteen"},
+		{"edition then a close other album", []SpotifyOption{
+			option("Nebraska", "Bruce Springsteen", 0.9),
+			option("Nebraska (Deluxe Edition)", "Bruce Springsteen", 0.89),
+			option("Nebraska", "Dave Alvin", 0.85),
+		}, ""},
+	}
+	for _, tt := range tests {
+		got, ok := confidentMatch(tt.scored, 0.8)
+		if ok != (tt.want != "") || got.Url != tt.want {
+			t.Errorf("%s: confidentMatch = %q, %v, want %q", tt.name, got.Url, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+// replayUser is who replayed decisions are recorded as.
+const replayUser = "spotify-replay"
+
+type tabDecision struct {
+	line  int
+	oldId string
+	url   string
+	state string
+}
+
+// readSpotifyTab reads the decisions in a spotify.tab file, the last one
+// for each oldId winning. Old lines have no state: a url means linked and
+// an empty url no-match.
+func readSpotifyTab(r io.Reader) ([]tabDecision, []string, error) {
+	latest := map[string]int{}
+	decisions := []tabDecision{}
+	bad := []string{}
+
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		d := tabDecision{line: n, oldId: strings.TrimSpace(fields[0])}
+		if len(fields) > 1 {
+			d.url = strings.TrimSpace(fields[1])
+		}
+		if len(fields) > 2 {
+			d.state = strings.TrimSpace(fields[2])
+		} else if d.url != "" {
+			d.state = spotifyLinked
+		} else {
+			d.state = spotifyNoMatch
+		}
+
+		if d.oldId == "" || len(fields) < 2 || len(fields) > 3 || !validSpotifyState(d.state) || (d.state == spotifyLinked) != (d.url != "") {
+			bad = append(bad, fmt.Sprintf("line %d: %q", n, line))
+			continue
+		}
+
+		if i, ok := latest[d.oldId]; ok {
+			decisions[i] = d
+		} else {
+			latest[d.oldId] = len(decisions)
+			decisions = append(decisions, d)
+		}
+	}
+
+	return decisions, bad, scanner.Err()
+}
+
+type ReplayTarget struct {
+	Uid     string `json:"uid"`
+	Id      string `json:"oldId"`
+	State   string `json:"spotify_state"`
+	Spotify string `json:"spotify"`
+}
+
+type ReplayTargetResponse struct {
+	Content []ReplayTarget `json:"content"`
+}
+
+// replayTargets looks up the content of the oldIds.
+func replayTargets(ctx context.Context, dg *dgo.Dgraph, oldIds []string) (map[string]ReplayTarget, error) {
+	targets := map[string]ReplayTarget{}
+
+	for i := 0; i < len(oldIds); i += matchPageSize {
+		end := min(i+matchPageSize, len(oldIds))
+
+		ids, err := json.Marshal(oldIds[i:end])
+		if err != nil {
+			return nil, err
+		}
+
+		q := `{
+			content(func: eq(oldId, ` + string(ids) + `)) @filter(type(Content)) {
+				uid
+				oldId
+				spotify_state
+				spotify
+			}
+		}`
+
+		txn := dg.NewReadOnlyTxn()
+		res, err := txn.Query(ctx, q)
+		txn.Discard(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var resp ReplayTargetResponse
+		err = json.Unmarshal(res.Json, &resp)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range resp.Content {
+			targets[c.Id] = c
+		}
+	}
+
+	return targets, nil
+}
+
+const (
+	replayApply     = "apply"
+	replayUnchanged = "unchanged"
+	replayConflict  = "conflict"
+)
+
+// replayOutcome is what replaying d does to t. Only content still waiting
+// for a decision is changed. Content not migrated yet holds its decision
+// in the old value, where only "x" is waiting.
+func replayOutcome(t ReplayTarget, d tabDecision) string {
+	state, url := t.State, t.Spotify
+	if state == "" {
+		state = legacySpotifyState(url)
+		if state != spotifyLinked {
+			url = ""
+		}
+	}
+
+	switch {
+	case state == d.state && url == d.url:
+		return replayUnchanged
+	case state == spotifyPending || state == spotifyNeedsReview:
+		return replayApply
+	}
+	return replayConflict
+}
+
+// replaySpotify reapplies the decisions in a spotify.tab file. Content
+// that already has the decision is left alone and content where Dgraph
+// holds a different decision is reported, not changed, so the replay can
+// be run any number of times.
+func (app *application) replaySpotify(ctx context.Context, path string) error {
+	dc := api.NewDgraphClient(app.conn)
+	dg := dgo.NewDgraphClient(dc)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decisions, bad, err := readSpotifyTab(f)
+	if err != nil {
+		return err
+	}
+	for _, b := range bad {
+		log.Printf("Skipping bad %s", b)
+	}
+
+	oldIds := []string{}
+	for _, d := range decisions {
+		oldIds = append(oldIds, d.oldId)
+	}
+	targets, err := replayTargets(ctx, dg, oldIds)
+	if err != nil {
+		return err
+	}
+
+	applied, unchanged, conflicts, missing := 0, 0, 0, 0
+	for _, d := range decisions {
+		t, ok := targets[d.oldId]
+		if !ok {
+			log.Printf("Line %d: no content with oldId %s", d.line, d.oldId)
+			missing++
+			continue
+		}
+
+		switch replayOutcome(t, d) {
+		case replayUnchanged:
+			unchanged++
+			continue
+		case replayConflict:
+			has := t.State
+			if has == "" {
+				has = "unmigrated"
+			}
+			log.Printf("Conflict on line %d, %s (%s): file says %s %s, Dgraph has %s %q", d.line, d.oldId, t.Uid, d.state, d.url, has, t.Spotify)
+			conflicts++
+			continue
+		}
+
+		err = setSpotifyState(ctx, dg, t.Uid, d.state, d.url, replayUser)
+		if err != nil {
+			return err
+		}
+		applied++
+	}
+
+	log.Printf("Spotify replay of %s: %d applied, %d already in place, %d conflicts, %d unknown oldIds, %d bad lines", path, applied, unchanged, conflicts, missing, len(bad))
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadSpotifyTab(t *testing.T) {
+	const url = "https://open.spotify.com/album/a1"
+
+	tests := []struct {
+		name  string
+		input string
+		want  []tabDecision
+		bad   int
+	}{
+		{
+			name:  "old two column lines",
+			input: "12\t" + url + "\n13\t\n",
+			want: []tabDecision{
+				{line: 1, oldId: "12", url: url, state: spotifyLinked},
+				{line: 2, oldId: "13", state: spotifyNoMatch},
+			},
+		},
+		{
+			name:  "three column lines",
+			input: "12\t" + url + "\tlinked\r\n13\t\tskipped\r\n\n14\t\tneeds-review\n",
+			want: []tabDecision{
+				{line: 1, oldId: "12", url: url, state: spotifyLinked},
+				{line: 2, oldId: "13", state: spotifySkipped},
+				{line: 4, oldId: "14", state: spotifyNeedsReview},
+			},
+		},
+		{
+			name: "bad lines",
+			input: strings.Join([]string{
+				"12",
+				"\t" + url,
+				"12\t" + url + "\tlinked\textra",
+				"12\t\tlinked",
+				"12\t" + url + "\tno-match",
+				"12\t\tmaybe",
+				"13\t\tno-match",
+			}, "\n"),
+			want: []tabDecision{
+				{line: 7, oldId: "13", state: spotifyNoMatch},
+			},
+			bad: 6,
+		},
+		{
+			name:  "last decision wins in the place of the first",
+			input: "12\t" + url + "\n13\t\n12\t\tskipped\n",
+			want: []tabDecision{
+				{line: 3, oldId: "12", state: spotifySkipped},
+				{line: 2, oldId: "13", state: spotifyNoMatch},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, bad, err := readSpotifyTab(strings.NewReader(tt.input))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(bad) != tt.bad {
+			t.Errorf("%s: bad = %q, want %d lines", tt.name, bad, tt.bad)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: decision %d = %+v, want %+v", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestReplayOutcome(t *testing.T) {
+	const url = "https://open.spotify.com/album/a1"
+	const other = "https://open.spotify.com/album/b2"
+	linked := tabDecision{oldId: "12", url: url, state: spotifyLinked}
+	noMatch := tabDecision{oldId: "12", state: spotifyNoMatch}
+
+	tests := []struct {
+		name   string
+		target ReplayTarget
+		d      tabDecision
+		want   string
+	}{
+		{"pending", ReplayTarget{State: spotifyPending}, linked, replayApply},
+		{"needs review", ReplayTarget{State: spotifyNeedsReview, Spotify: other}, linked, replayApply},
+		{"already linked", ReplayTarget{State: spotifyLinked, Spotify: url}, linked, replayUnchanged},
+		{"linked elsewhere", ReplayTarget{State: spotifyLinked, Spotify: other}, linked, replayConflict},
+		{"skipped", ReplayTarget{State: spotifySkipped}, linked, replayConflict},
+		{"unmigrated x", ReplayTarget{Spotify: spotifyLegacyPending}, linked, replayApply},
+		{"unmigrated same url", ReplayTarget{Spotify: url}, linked, replayUnchanged},
+		{"unmigrated other url", ReplayTarget{Spotify: other}, linked, replayConflict},
+		{"unmigrated no match", ReplayTarget{}, linked, replayConflict},
+		{"unmigrated no match kept", ReplayTarget{}, noMatch, replayUnchanged},
+		{"unmigrated url against no match", ReplayTarget{Spotify: url}, noMatch, replayConflict},
+	}
+	for _, tt := range tests {
+		if got := replayOutcome(tt.target, tt.d); got != tt.want {
+			t.Errorf("%s: replayOutcome = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// SearchFilter narrows a Spotify search. Albums are always kept, singles
+// (which is what Spotify calls EPs too) and compilations only when asked
+// for. Market limits the answer to records playable there.
+type SearchFilter struct {
+	Market       string
+	Singles      bool
+	Compilations bool
+}
+
+func (f SearchFilter) keeps(albumType string) bool {
+	switch albumType {
+	case "album":
+		return true
+	case "single":
+		return f.Singles
+	case "compilation":
+		return f.Compilations
+	}
+	return false
+}
+
+// query is the filter as url parameters for the admin page, with state.
+func (f SearchFilter) query(state string) string {
+	v := url.Values{"state": {state}}
+	if f.Market != "" {
+		v.Set("market", f.Market)
+	}
+	if f.Singles {
+		v.Set("singles", "1")
+	}
+	if f.Compilations {
+		v.Set("compilations", "1")
+	}
+	return v.Encode()
+}
+
+// searchTerms drops edition notes and punctuation that Spotify's search
+// trips over, keeping case and diacritics.
+func searchTerms(s string) string {
+	s = editionSuffix.ReplaceAllString(s, "")
+
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune(' ')
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// searchQueries are the queries to try for a record, most exact first:
+// as written, without punctuation, with Swedish letters folded and last
+// without the artist. Spotify ignores case, so queries that only differ
+// in case are tried once.
+func searchQueries(artist, album string) []string {
+	artist = searchArtist(artist)
+	various := variousArtists(artist) || strings.TrimSpace(artist) == ""
+	with := func(album, artist string) string {
+		if various {
+			return album
+		}
+		return fmt.Sprintf("%s artist:%s", album, artist)
+	}
+
+	candidates := []string{
+		with(album, artist),
+		with(searchTerms(album), searchTerms(artist)),
+		with(foldText(searchTerms(album)), foldText(searchTerms(artist))),
+		searchTerms(album),
+	}
+
+	queries := []string{}
+	seen := map[string]bool{}
+	for _, q := range candidates {
+		key := strings.ToLower(q)
+		if strings.TrimSpace(q) != "" && !seen[key] {
+			seen[key] = true
+			queries = append(queries, q)
+		}
+	}
+	return queries
+}
+
+// Search looks for the album, trying looser queries until one finds
+// something the filter keeps. Editions of the same album are folded into
+// one option.
+func (sp *Spotify) Search(artist, album string, filter SearchFilter) ([]SpotifyOption, error) {
+	for _, query := range searchQueries(artist, album) {
+		q := url.Values{}
+		q.Add("q", query)
+		q.Add("type", "album")
+		q.Add("limit", "15")
+		if filter.Market != "" {
+			q.Add("market", filter.Market)
+		}
+
+		found := SearchResponse{}
+
+		err := sp.get(sp.apiURL+"/v1/search", q, &found)
+		if err != nil {
+			return nil, err
+		}
+
+		opts := []SpotifyOption{}
+		for _, a := range found.Albums.Items {
+			if !filter.keeps(a.AlbumType) {
+				continue
+			}
+
+			names := []string{}
+
+			for _, v := range a.Artists {
+				names = append(names, v.Name)
+			}
+
+			year, _ := strconv.Atoi(strings.SplitN(a.ReleaseDate, "-", 2)[0])
+
+			opt := SpotifyOption{
+				Name:    fmt.Sprintf("%s - %s", strings.Join(names, " & "), a.Name),
+				Url:     a.ExternalUrls["spotify"],
+				Artists: names,
+				Album:   a.Name,
+				Year:    year,
+				Tracks:  a.TotalTracks,
+				Type:    a.AlbumType,
+			}
+			if len(a.Images) > 0 {
+				opt.Image = a.Images[0].URL
+			}
+			opts = append(opts, opt)
+		}
+
+		if len(opts) > 0 {
+			return dedupeEditions(opts), nil
+		}
+	}
+
+	return []SpotifyOption{}, nil
+}
+
+// dedupeEditions keeps one option per album and artists, preferring the
+// one without an edition note and then the oldest. Editions counts the
+// ones left out.
+func dedupeEditions(opts []SpotifyOption) []SpotifyOption {
+	better := func(a, b SpotifyOption) bool {
+		aPlain, bPlain := !editionSuffix.MatchString(a.Album), !editionSuffix.MatchString(b.Album)
+		if aPlain != bPlain {
+			return aPlain
+		}
+		return a.Year != 0 && (b.Year == 0 || a.Year < b.Year)
+	}
+
+	index := map[string]int{}
+	out := []SpotifyOption{}
+	for _, o := range opts {
+		key := normalizeName(o.Album) + "|" + normalizeName(strings.Join(o.Artists, " "))
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(out)
+			out = append(out, o)
+			continue
+		}
+
+		editions := out[i].Editions + 1
+		if better(o, out[i]) {
+			out[i] = o
+		}
+		out[i].Editions = editions
+	}
+	return out
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/jsol/rootsy-dgraph/spotifyfake"
+)
+
+func TestSearchQueries(t *testing.T) {
+	tests := []struct {
+		artist, album string
+		want          []string
+	}{
+		{"Bruce Springsteen", "Nebraska", []string{
+			"Nebraska artist:Bruce Springsteen",
+			"Nebraska",
+		}},
+		{"Band, The", "Music from Big Pink (Remastered)", []string{
+			"Music from Big Pink (Remastered) artist:Band",
+			"Music from Big Pink artist:Band",
+			"Music from Big Pink",
+		}},
+		{"Åsa Öberg", "Sånger från en stad!", []string{
+			"Sånger från en stad! artist:Åsa Öberg",
+			"Sånger från en stad artist:Åsa Öberg",
+			"sanger fran en stad artist:asa oberg",
+			"Sånger från en stad",
+		}},
+		// Various artists are searched by album only.
+		{"Blandade artister", "Americana Vol. 2", []string{
+			"Americana Vol. 2",
+			"Americana Vol 2",
+		}},
+		{"", "Nebraska", []string{"Nebraska"}},
+	}
+	for _, tt := range tests {
+		if got := searchQueries(tt.artist, tt.album); !slices.Equal(got, tt.want) {
+			t.Errorf("searchQueries(%q, %q) = %q, want %q", tt.artist, tt.album, got, tt.want)
+		}
+	}
+}
+
+func TestDedupeEditions(t *testing.T) {
+	option := func(album string, year int) SpotifyOption {
+		return SpotifyOption{Album: album, Artists: []string{"Bruce Springsteen"}, Year: year, Url: album + "/" + string(rune('0'+year%10))}
+	}
+
+	tests := []struct {
+		name     string
+		opts     []SpotifyOption
+		want     []string
+		editions []int
+	}{
+		{"nothing to fold", []SpotifyOption{option("Nebraska", 1982), option("The River", 1980)},
+			[]string{"Nebraska/2", "The River/0"}, []int{0, 0}},
+		{"plain name wins over an older edition", []SpotifyOption{option("Nebraska (2015 Remaster)", 1981), option("Nebraska", 1982)},
+			[]string{"Nebraska/2"}, []int{1}},
+		{"oldest plain name wins", []SpotifyOption{option("Nebraska", 2015), option("Nebraska", 1982), option("Nebraska (Deluxe Edition)", 2025)},
+			[]string{"Nebraska/2"}, []int{2}},
+		{"a known year wins over none", []SpotifyOption{option("Nebraska", 0), option("Nebraska", 2015)},
+			[]string{"Nebraska/5"}, []int{1}},
+		{"first place is kept", []SpotifyOption{option("The River", 1980), option("Nebraska", 2015), option("The River (Expanded)", 2000), option("Nebraska", 1982)},
+			[]string{"The River/0", "Nebraska/2"}, []int{1, 1}},
+	}
+	for _, tt := range tests {
+		got := dedupeEditions(tt.opts)
+		urls, editions := []string{}, []int{}
+		for _, o := range got {
+			urls = append(urls, o.Url)
+			editions = append(editions, o.Editions)
+		}
+		if !slices.Equal(urls, tt.want) || !slices.Equal(editions, tt.editions) {
+			t.Errorf("%s: got %q with editions %v, want %q with %v", tt.name, urls, editions, tt.want, tt.editions)
+		}
+	}
+}
+
+func TestSearchFilterQuery(t *testing.T) {
+	tests := []struct {
+		filter SearchFilter
+		want   string
+	}{
+		{SearchFilter{}, "state=pending"},
+		{SearchFilter{Market: "SE"}, "market=SE&state=pending"},
+		{SearchFilter{Market: "SE", Singles: true, Compilations: true}, "compilations=1&market=SE&singles=1&state=pending"},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.query(spotifyPending); got != tt.want {
+			t.Errorf("%+v.query = %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestSpotifySearch(t *testing.T) {
+	srv, sp, _ := newTestSpotify(t)
+	srv.AddAlbum(spotifyfake.Album{ID: "orig", Name: "Nebraska", Artists: []string{"Bruce Springsteen"}, ReleaseDate: "1982-09-30",
+		Images: []spotifyfake.Image{{URL: "https://i.scdn.co/image/nebraska"}}, Tracks: []string{"t1", "t2"}})
+	srv.AddAlbum(spotifyfake.Album{ID: "deluxe", Name: "Nebraska (Deluxe Edition)", Artists: []string{"Bruce Springsteen"}, ReleaseDate: "2025-10-17"})
+	srv.AddAlbum(spotifyfake.Album{ID: "se", Name: "Sånger från en stad", Artists: []string{"Åsa Öberg"}, Markets: []string{"SE"}})
+	srv.AddAlbum(spotifyfake.Album{ID: "ep", Name: "Live EP", Artists: []string{"Foo"}, AlbumType: "single"})
+
+	opts, err := sp.Search("Bruce Springsteen", "Nebraska", SearchFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts) != 1 {
+		t.Fatalf("got %v, want the editions folded into one", opts)
+	}
+	o := opts[0]
+	if o.Url != "https://open.spotify.com/album/orig" || o.Year != 1982 || o.Tracks != 2 || o.Editions != 1 || o.Image == "" {
+		t.Errorf("got %+v", o)
+	}
+
+	tests := []struct {
+		artist, album string
+		filter        SearchFilter
+		want          int
+	}{
+		{"Åsa Öberg", "Sånger från en stad", SearchFilter{Market: "SE"}, 1},
+		{"Åsa Öberg", "Sånger från en stad", SearchFilter{Market: "US"}, 0},
+		{"Foo", "Live EP", SearchFilter{}, 0},
+		{"Foo", "Live EP", SearchFilter{Singles: true}, 1},
+		// Falls back to searching without the artist.
+		{"Someone Else", "Live EP", SearchFilter{Singles: true}, 1},
+		{"Nobody", "Nothing", SearchFilter{}, 0},
+	}
+	for _, tt := range tests {
+		opts, err := sp.Search(tt.artist, tt.album, tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(opts) != tt.want {
+			t.Errorf("Search(%q, %q, %+v) = %v, want %d options", tt.artist, tt.album, tt.filter, opts, tt.want)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+// Spotify linking states, kept in spotify_state. spotify holds the album
+// url and is only set when linked.
+const (
+	spotifyPending     = "pending"
+	spotifyLinked      = "linked"
+	spotifyNoMatch     = "no-match"
+	spotifySkipped     = "skipped"
+	spotifyNeedsReview = "needs-review"
+)
+
+// spotifyLegacyPending is what spotify held for albums waiting for a link
+// before there were states. The importer may still write it.
+const spotifyLegacyPending = "x"
+
+var spotifyStates = []string{spotifyPending, spotifyNeedsReview, spotifySkipped, spotifyNoMatch, spotifyLinked}
+
+// spotifyDecisions are the states a person or the match job puts content
+// in, and that undo takes it out of.
+var spotifyDecisions = []string{spotifyLinked, spotifyNoMatch, spotifySkipped}
+
+func validSpotifyState(state string) bool {
+	for _, s := range spotifyStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+const spotifySchema = `
+	spotify_state: string @index(exact) .
+	spotify_prev: string .
+	spotify_prev_url: string .
+	spotify_by: string @index(exact) .
+	spotify_at: datetime @index(hour) .
+`
+
+// spotifyStateVar selects the content in state into a var named v and
+// returns the var blocks and the root function to use them. Pending also
+// takes in content still holding spotifyLegacyPending.
+func spotifyStateVar(v, state string) (vars, fn string) {
+	vars = fmt.Sprintf("%s as var(func: eq(spotify_state, %q))\n", v, state)
+	fn = "uid(" + v + ")"
+	if state == spotifyPending {
+		vars += fmt.Sprintf("%sx as var(func: eq(spotify, %q)) @filter(NOT has(spotify_state))\n", v, spotifyLegacyPending)
+		fn = "uid(" + v + ", " + v + "x)"
+	}
+	return vars, fn
+}
+
+// setSpotifyState records a decision on uid with who made it and when.
+// The previous state and url are kept in spotify_prev and
+// spotify_prev_url so the decision can be undone.
+func setSpotifyState(ctx context.Context, dg *dgo.Dgraph, uid, state, url, by string) error {
+	if !validUid(uid) || !validSpotifyState(state) {
+		return fmt.Errorf("bad spotify state %q for %q", state, uid)
+	}
+	if state == spotifyLinked && url == "" {
+		return fmt.Errorf("linking %s without a url", uid)
+	}
+
+	set := fmt.Sprintf(`uid(c) <spotify_prev> val(s) .
+		uid(c) <spotify_prev_url> val(u) .
+		uid(c) <spotify_state> %q .
+		uid(c) <spotify_by> %q .
+		uid(c) <spotify_at> %q .
+	`, state, by, time.Now().UTC().Format(time.RFC3339))
+	return changeSpotify(ctx, dg, uid, state, url, "uid(c) <spotify_prev> * .\nuid(c) <spotify_prev_url> * .\n", set)
+}
+
+// changeSpotify deletes del and then sets set and the url for state on
+// uid. Both can use the current state in s and url in u.
+func changeSpotify(ctx context.Context, dg *dgo.Dgraph, uid, state, url, del, set string) error {
+	if state == spotifyLinked {
+		set += fmt.Sprintf("uid(c) <spotify> %q .\n", url)
+	} else {
+		del += "uid(c) <spotify> * .\n"
+	}
+
+	// The deletes run first so values that are not replaced, like a
+	// missing previous url, do not linger.
+	req := &api.Request{
+		Query: `query State($uid: string) {
+			c as var(func: uid($uid)) @filter(type(Content)) {
+				s as spotify_state
+				u as spotify
+			}
+		}`,
+		Vars: map[string]string{"$uid": uid},
+		Mutations: []*api.Mutation{{
+			Cond:      `@if(eq(len(c), 1))`,
+			DelNquads: []byte(del),
+		}, {
+			Cond:      `@if(eq(len(c), 1))`,
+			SetNquads: []byte(set),
+		}},
+		CommitNow: true,
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	_, err := txn.Do(ctx, req)
+	return err
+}
+
+type SpotifyDecision struct {
+	Uid     string `json:"uid"`
+	Id      string `json:"oldId"`
+	State   string `json:"spotify_state"`
+	Prev    string `json:"spotify_prev"`
+	PrevUrl string `json:"spotify_prev_url"`
+	Spotify string `json:"spotify"`
+}
+
+type SpotifyDecisionResponse struct {
+	Decisions []SpotifyDecision `json:"decisions"`
+}
+
+// undoSpotify puts the album of the latest decision by who back in the
+// state and url it had before. The undone album no longer counts as a
+// decision by who, so repeated undos walk back through who's albums; each
+// album only remembers one step.
+func undoSpotify(ctx context.Context, dg *dgo.Dgraph, by string) (*SpotifyDecision, error) {
+	q := `query Last($by: string) {
+		decisions(func: eq(spotify_by, $by), orderdesc: spotify_at, first: 1) @filter(type(Content) AND eq(spotify_state, ["` + strings.Join(spotifyDecisions, `", "`) + `"])) {
+			uid
+			oldId
+			spotify_state
+			spotify_prev
+			spotify_prev_url
+			spotify
+		}
+	}`
+
+	txn := dg.NewReadOnlyTxn()
+	res, err := txn.QueryWithVars(ctx, q, map[string]string{"$by": by})
+	txn.Discard(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp SpotifyDecisionResponse
+	err = json.Unmarshal(res.Json, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Decisions) == 0 {
+		return nil, nil
+	}
+
+	d := resp.Decisions[0]
+	prev, url := d.Prev, ""
+	if prev == spotifyLinked {
+		url = d.PrevUrl
+	}
+	if !validSpotifyState(prev) || prev == spotifyLinked && url == "" {
+		prev = spotifyPending
+	}
+
+	// Who, when and the step back go with the undone decision.
+	set := fmt.Sprintf("uid(c) <spotify_state> %q .\n", prev)
+	del := "uid(c) <spotify_by> * .\nuid(c) <spotify_at> * .\nuid(c) <spotify_prev> * .\nuid(c) <spotify_prev_url> * .\n"
+	err = changeSpotify(ctx, dg, d.Uid, prev, url, del, set)
+	if err != nil {
+		return nil, err
+	}
+	saveSpotify(d.Id, url, prev)
+
+	return &d, nil
+}
+
+// StateCount is a state tab on the admin page. Href keeps the search
+// filter.
+type StateCount struct {
+	State    string
+	Count    int
+	Selected bool
+	Href     string
+}
+
+// spotifyCounts counts albums in each state.
+func spotifyCounts(ctx context.Context, dg *dgo.Dgraph, selected string) ([]StateCount, error) {
+	var q strings.Builder
+	q.WriteString("{\n")
+	for i, s := range spotifyStates {
+		vars, fn := spotifyStateVar(fmt.Sprintf("v%d", i), s)
+		q.WriteString(vars)
+		fmt.Fprintf(&q, `s%d(func: %s) @filter(type(Content) AND NOT eq(type, "article")) { count(uid) }`+"\n", i, fn)
+	}
+	q.WriteString("}")
+
+	txn := dg.NewReadOnlyTxn()
+	res, err := txn.Query(ctx, q.String())
+	txn.Discard(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp map[string][]struct {
+		Count int `json:"count"`
+	}
+	err = json.Unmarshal(res.Json, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := []StateCount{}
+	for i, s := range spotifyStates {
+		c := StateCount{State: s, Selected: s == selected}
+		if list := resp[fmt.Sprintf("s%d", i)]; len(list) > 0 {
+			c.Count = list[0].Count
+		}
+		counts = append(counts, c)
+	}
+	return counts, nil
+}
+
+type SpotifyLegacy struct {
+	Uid     string `json:"uid"`
+	Spotify string `json:"spotify"`
+}
+
+type SpotifyLegacyResponse struct {
+	Content []SpotifyLegacy `json:"content"`
+}
+
+// legacySpotifyState is the state content without spotify_state is in,
+// judged by its old spotify value.
+func legacySpotifyState(spotify string) string {
+	switch strings.TrimSpace(spotify) {
+	case spotifyLegacyPending:
+		return spotifyPending
+	case "":
+		return spotifyNoMatch
+	}
+	return spotifyLinked
+}
+
+// migrateSpotify adds the state schema and moves content still using the
+// old values to states: "x" is pending, "" is no-match and a url is
+// linked. Content that has a state is left alone, so it is safe to run
+// again. It runs as the spotify-migrate subcommand; until then the queue
+// and the match job treat "x" as pending.
+func (app *application) migrateSpotify(ctx context.Context) error {
+	dc := api.NewDgraphClient(app.conn)
+	dg := dgo.NewDgraphClient(dc)
+
+	err := dg.Alter(ctx, &api.Operation{Schema: spotifySchema})
+	if err != nil {
+		return err
+	}
+
+	q := `query Legacy($first: int) {
+		content(func: has(spotify), first: $first) @filter(type(Content) AND NOT has(spotify_state)) {
+			uid
+			spotify
+		}
+	}`
+
+	at := time.Now().UTC().Format(time.RFC3339)
+	migrated := 0
+	for {
+		txn := dg.NewReadOnlyTxn()
+		res, err := txn.QueryWithVars(ctx, q, map[string]string{"$first": fmt.Sprint(matchPageSize)})
+		txn.Discard(ctx)
+		if err != nil {
+			return err
+		}
+
+		var resp SpotifyLegacyResponse
+		err = json.Unmarshal(res.Json, &resp)
+		if err != nil {
+			return err
+		}
+		if len(resp.Content) == 0 {
+			break
+		}
+
+		var set, del strings.Builder
+		for _, c := range resp.Content {
+			state := legacySpotifyState(c.Spotify)
+			if state != spotifyLinked {
+				fmt.Fprintf(&del, "<%s> <spotify> * .\n", c.Uid)
+			}
+			fmt.Fprintf(&set, "<%s> <spotify_state> %q .\n<%s> <spotify_by> \"migration\" .\n<%s> <spotify_at> %q .\n", c.Uid, state, c.Uid, c.Uid, at)
+		}
+
+		txn = dg.NewTxn()
+		_, err = txn.Mutate(ctx, &api.Mutation{
+			SetNquads: []byte(set.String()),
+			DelNquads: []byte(del.String()),
+			CommitNow: true,
+		})
+		txn.Discard(ctx)
+		if err != nil {
+			return err
+		}
+		migrated += len(resp.Content)
+	}
+
+	if migrated > 0 {
+		log.Printf("Migrated %d Spotify links to states", migrated)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+)
+
+// swedishStopwords is the Snowball stop word list for Swedish.
+var swedishStopwords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`
+		och det att i en jag hon som han på den med var sig för så till är
+		men ett om hade de av icke mig du henne då sin nu har inte hans honom
+		skulle hennes där min man ej vid kunde något från ut när efter upp vi
+		dem vara vad över än dig kan sina här ha mot alla under någon eller
+		allt mycket sedan ju denna själv detta åt utan varit hur ingen mitt
+		ni bli blev oss din dessa några deras blir mina samma vilken er sådan
+		vår blivit dess inom mellan sådant varför varje vilka ditt vem vilket
+		sitta sådana vart dina vars vårt våra ert era vilkas
+	`) {
+		swedishStopwords[w] = true
+	}
+}
+
+var (
+	swedishStep1 = []string{
+		"heterna", "hetens", "anden", "heten", "heter", "arnas", "ernas",
+		"ornas", "andes", "arens", "andet", "arna", "erna", "orna", "ande",
+		"arne", "aste", "aren", "ades", "erns", "ade", "are", "ern", "ens",
+		"het", "ast", "ad", "en", "ar", "er", "or", "as", "es", "at", "a",
+		"e",
+	}
+	swedishStep2 = []string{"dd", "gd", "nn", "dt", "gt", "kt", "tt"}
+)
+
+func isSwedishVowel(r rune) bool {
+	return strings.ContainsRune("aeiouyäåö", r)
+}
+
+// swedishR1 is the index of the rune after the first non-vowel that
+// follows a vowel, but never less than 3.
+func swedishR1(word []rune) int {
+	for i := 1; i < len(word); i++ {
+		if !isSwedishVowel(word[i]) && isSwedishVowel(word[i-1]) {
+			if i+1 < 3 {
+				return 3
+			}
+			return i + 1
+		}
+	}
+	return len(word)
+}
+
+// stemSwedish implements the Snowball Swedish stemmer on a lower case word.
+func stemSwedish(word string) string {
+	w := []rune(word)
+	r1 := swedishR1(w)
+	if r1 >= len(w) {
+		return word
+	}
+
+	region := func() string { return string(w[r1:]) }
+
+	found := false
+	for _, suffix := range swedishStep1 {
+		if strings.HasSuffix(region(), suffix) {
+			w = w[:len(w)-len([]rune(suffix))]
+			found = true
+			break
+		}
+	}
+	if !found && strings.HasSuffix(region(), "s") && len(w) >= 2 && strings.ContainsRune("bcdfghjklmnoprtvy", w[len(w)-2]) {
+		w = w[:len(w)-1]
+	}
+
+	for _, suffix := range swedishStep2 {
+		if len(w) > r1 && strings.HasSuffix(region(), suffix) {
+			w = w[:len(w)-1]
+			break
+		}
+	}
+
+	if len(w) > r1 {
+		switch {
+		case strings.HasSuffix(region(), "fullt"):
+			w = w[:len(w)-1]
+		case strings.HasSuffix(region(), "löst"):
+			w = w[:len(w)-1]
+		case strings.HasSuffix(region(), "lig"):
+			w = w[:len(w)-3]
+		case strings.HasSuffix(region(), "els"):
+			w = w[:len(w)-3]
+		case strings.HasSuffix(region(), "ig"):
+			w = w[:len(w)-2]
+		}
+	}
+
+	return string(w)
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+// The expected stems are the output of the Snowball Swedish stemmer.
+func TestStemSwedish(t *testing.T) {
+	tests := []struct {
+		word, want string
+	}{
+		{"i", "i"},
+		{"jakt", "jakt"},
+		{"jaktkarlarne", "jaktkarl"},
+		{"jaktkarlens", "jaktkarl"},
+		{"jalusierna", "jalusi"},
+		{"jammrade", "jammr"},
+		{"jammrande", "jammr"},
+		{"klokare", "klok"},
+		{"klokaste", "klok"},
+		{"klokheten", "klok"},
+		{"kärlekens", "kärlek"},
+		{"hundarnas", "hund"},
+		{"skivorna", "skiv"},
+		// Step 1 leaves the doubled n outside R1 alone.
+		{"mannen", "mann"},
+		// The s ending is only removed after a valid consonant.
+		{"bluesen", "blues"},
+		// Step 2 and 3: a consonant pair, then lig.
+		{"lyckligt", "lyck"},
+		{"hemligheter", "hem"},
+		{"hopplöst", "hopplös"},
+		{"kraftfullt", "kraftfull"},
+		{"kaffet", "kaffet"},
+	}
+	for _, tt := range tests {
+		if got := stemSwedish(tt.word); got != tt.want {
+			t.Errorf("stemSwedish(%q) = %q, want %q", tt.word, got, tt.want)
+		}
+	}
+}
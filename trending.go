@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+const popularCount = 24
+
+// trendingSmoothing keeps content with very few reads in total from
+// topping the list on a couple of recent reads.
+const trendingSmoothing = 5
+
+// loadCards fetches what the content list needs for the uids, keeping the
+// order of uids.
+func loadCards(ctx context.Context, dg *dgo.Dgraph, uids []string) ([]DGraphContent, error) {
+	valid := []string{}
+	for _, uid := range uids {
+		if validUid(uid) {
+			valid = append(valid, uid)
+		}
+	}
+	byUid := map[string]DGraphContent{}
+	for i := 0; i < len(valid); i += infoBatchSize {
+		end := i + infoBatchSize
+		if end > len(valid) {
+			end = len(valid)
+		}
+
+		content, err := loadPool(ctx, dg, `{
+			candidates(func: uid(`+strings.Join(valid[i:end], ",")+`)) @filter(type(Content)) {`+cardFields+`
+				read_count
+			}
+		}`)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range content {
+			byUid[c.Uid] = c
+		}
+	}
+
+	cards := []DGraphContent{}
+	for _, uid := range valid {
+		if c, ok := byUid[uid]; ok {
+			cards = append(cards, c)
+		}
+	}
+	return cards, nil
+}
+
+// trending ranks content by reads in the last days against its all-time
+// read_count: recent² / (all-time + smoothing). Content read mostly lately
+// rises, evergreen favourites with a steady trickle sink.
+func (app *application) trending(ctx context.Context, days, n int) ([]DGraphContent, error) {
+	return app.pools.get(fmt.Sprintf("trending/%d/%d", days, n), func() ([]DGraphContent, error) {
+		dc := api.NewDgraphClient(app.conn)
+		dg := dgo.NewDgraphClient(dc)
+
+		to := time.Now().UTC()
+		reads, err := loadReads(ctx, dg, to.AddDate(0, 0, -days), to)
+		if err != nil {
+			return nil, err
+		}
+
+		recent := map[string]int{}
+		uids := []string{}
+		for _, r := range reads {
+			if recent[r.content] == 0 {
+				uids = append(uids, r.content)
+			}
+			recent[r.content]++
+		}
+
+		cards, err := loadCards(ctx, dg, uids)
+		if err != nil {
+			return nil, err
+		}
+
+		score := func(c DGraphContent) float64 {
+			r := float64(recent[c.Uid])
+			return r * r / float64(c.ReadCount+trendingSmoothing)
+		}
+		sort.SliceStable(cards, func(i, j int) bool {
+			return score(cards[i]) > score(cards[j])
+		})
+		if len(cards) > n {
+			cards = cards[:n]
+		}
+
+		return cards, nil
+	})
+}
+
+func (app *application) popular(w http.ResponseWriter, r *http.Request) {
+	content := app.pool(r.Context(), "popular", `{
+		candidates(func: has(read_count), orderdesc: read_count, first: `+fmt.Sprint(popularCount)+`) @filter(type(Content)) {`+cardFields+`
+		}
+	}`)
+
+	app.executeTemplate(w, "listing", PrintListing{
+		Name:    "Mest lästa",
+		Path:    "/popular",
+		Content: content,
+		Links:   []DGraphLink{{Text: "Populärt just nu", Href: "/trending"}},
+	})
+}
+
+func (app *application) trendingPage(w http.ResponseWriter, r *http.Request) {
+	days := 7
+	if r.URL.Query().Get("days") == "30" {
+		days = 30
+	}
+
+	content, err := app.trending(r.Context(), days, popularCount)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Could not load trending content", http.StatusInternalServerError)
+		return
+	}
+
+	app.executeTemplate(w, "listing", PrintListing{
+		Name:    fmt.Sprintf("Populärt de senaste %d dagarna", days),
+		Path:    fmt.Sprintf("/trending?days=%d", days),
+		Content: content,
+		Links: []DGraphLink{
+			{Text: "7 dagar", Href: "/trending?days=7"},
+			{Text: "30 dagar", Href: "/trending?days=30"},
+			{Text: "Mest lästa genom tiderna", Href: "/popular"},
+		},
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	dgo "github.com/dgraph-io/dgo/v230"
+	"github.com/dgraph-io/dgo/v230/protos/api"
+)
+
+const viewBatchSize = 100
+
+// viewCounter aggregates card impressions in memory so page views do not
+// write to Dgraph. The counts are added to view_count by flush. It also
+// remembers the totals flushes wrote, since pooled content keeps the
+// view_count it was loaded with.
+type viewCounter struct {
+	mu      sync.Mutex
+	pending map[string]int
+	totals  map[string]int
+}
+
+func newViewCounter() *viewCounter {
+	return &viewCounter{pending: map[string]int{}, totals: map[string]int{}}
+}
+
+func (vc *viewCounter) add(content []DGraphContent) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for _, c := range content {
+		vc.pending[c.Uid]++
+	}
+}
+
+// count is the live view count of c: the newest of its loaded view_count
+// and the last flushed total, plus what is not flushed yet.
+func (vc *viewCounter) count(c DGraphContent) int {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	return max(c.ViewCount, vc.totals[c.Uid]) + vc.pending[c.Uid]
+}
+
+// stored records the totals a flush wrote.
+func (vc *viewCounter) stored(views []ViewCount) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for _, v := range views {
+		vc.totals[v.Uid] = v.ViewCount
+	}
+}
+
+// take empties the counter and returns what was in it.
+func (vc *viewCounter) take() map[string]int {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	pending := vc.pending
+	vc.pending = map[string]int{}
+	return pending
+}
+
+// restore puts counts back after a failed flush.
+func (vc *viewCounter) restore(counts map[string]int) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for uid, n := range counts {
+		vc.pending[uid] += n
+	}
+}
+
+type ViewCount struct {
+	Uid       string `json:"uid"`
+	ViewCount int    `json:"view_count"`
+}
+
+type ViewCountResponse struct {
+	Views []ViewCount `json:"views"`
+}
+
+// flushViews adds the aggregated impressions to view_count. The flush is
+// the only writer of view_count, so reading and writing the counts in one
+// transaction per batch does not lose increments.
+func (app *application) flushViews(ctx context.Context) error {
+	pending := app.views.take()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	dc := api.NewDgraphClient(app.conn)
+	dg := dgo.NewDgraphClient(dc)
+
+	uids := make([]string, 0, len(pending))
+	for uid := range pending {
+		if validUid(uid) {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Strings(uids)
+
+	for len(uids) > 0 {
+		n := viewBatchSize
+		if n > len(uids) {
+			n = len(uids)
+		}
+		batch := uids[:n]
+
+		stored, err := addViews(ctx, dg, batch, pending)
+		if err != nil {
+			left := map[string]int{}
+			for _, uid := range uids {
+				left[uid] = pending[uid]
+			}
+			app.views.restore(left)
+			return err
+		}
+		app.views.stored(stored)
+		uids = uids[n:]
+	}
+
+	return nil
+}
+
+// addViews adds the pending counts of uids to view_count and returns the
+// new totals.
+func addViews(ctx context.Context, dg *dgo.Dgraph, uids []string, pending map[string]int) ([]ViewCount, error) {
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	q := `{
+		views(func: uid(` + strings.Join(uids, ",") + `)) @filter(type(Content)) {
+			uid
+			view_count
+		}
+	}`
+
+	res, err := txn.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp ViewCountResponse
+	err = json.Unmarshal(res.Json, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range resp.Views {
+		resp.Views[i].ViewCount += pending[resp.Views[i].Uid]
+	}
+	if len(resp.Views) == 0 {
+		return nil, nil
+	}
+
+	pb, err := json.Marshal(resp.Views)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{
+		SetJson:   pb,
+		CommitNow: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Views, nil
+}
+
+// viewWeight favours content that has been shown less. Pooled content is
+// weighed by the live count, not the one it was loaded with.
+func (app *application) viewWeight(c DGraphContent) float64 {
+	return 1 / float64(1+app.views.count(c))
+}
+
+// sampleContent picks n items without replacement, each with a probability
+// proportional to its weight (Efraimidis-Spirakis weighted reservoir).
+func sampleContent(list []DGraphContent, n int, weight func(DGraphContent) float64) []DGraphContent {
+	type keyed struct {
+		key float64
+		c   DGraphContent
+	}
+
+	keys := make([]keyed, 0, len(list))
+	for _, c := range list {
+		w := weight(c)
+		if w <= 0 {
+			continue
+		}
+		keys = append(keys, keyed{math.Pow(rand.Float64(), 1/w), c})
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].key > keys[j].key
+	})
+
+	out := []DGraphContent{}
+	for i := 0; i < n && i < len(keys); i++ {
+		out = append(out, keys[i].c)
+	}
+	return out
+}
+
+// loadPool runs a query whose result block is named candidates.
+func loadPool(ctx context.Context, dg *dgo.Dgraph, q string) ([]DGraphContent, error) {
+	txn := dg.NewReadOnlyTxn()
+	defer txn.Discard(ctx)
+
+	res, err := txn.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp CandidatesResponse
+	err = json.Unmarshal(res.Json, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("pool: %w", err)
+	}
+
+	return resp.Candidates, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestViewCounterCount(t *testing.T) {
+	vc := newViewCounter()
+	pooled := DGraphContent{Uid: "0x1", ViewCount: 10}
+
+	tests := []struct {
+		name string
+		do   func()
+		want int
+	}{
+		{"as loaded", func() {}, 10},
+		{"pending views", func() { vc.add([]DGraphContent{pooled, pooled}) }, 12},
+		{"flushed", func() {
+			vc.take()
+			vc.stored([]ViewCount{{Uid: "0x1", ViewCount: 12}})
+		}, 12},
+		{"flushed and pending", func() { vc.add([]DGraphContent{pooled}) }, 13},
+		{"failed flush restored", func() { vc.restore(vc.take()) }, 13},
+	}
+	for _, tt := range tests {
+		tt.do()
+		if got := vc.count(pooled); got != tt.want {
+			t.Errorf("%s: count = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Content loaded after the flush is not counted twice.
+	fresh := DGraphContent{Uid: "0x1", ViewCount: 12}
+	if got := vc.count(fresh); got != 13 {
+		t.Errorf("fresh content: count = %d, want 13", got)
+	}
+}